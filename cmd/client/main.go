@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/paulGUZU/fsak/internal/client"
 	"github.com/paulGUZU/fsak/pkg/banner"
 	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/localapi"
+	"github.com/paulGUZU/fsak/pkg/logging"
 )
 
 func main() {
@@ -17,26 +26,52 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if _, err := logging.Setup(cfg.Log, os.Stderr); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
 
-	// Initialize Address Pool
-	pool, err := client.NewAddressPool(cfg.Addresses, cfg.Port, cfg.Host, cfg.TLS)
-	if err != nil {
-		log.Fatalf("Failed to init address pool: %v", err)
+	// Address pool, transport, local DNS server and proxy
+	ctrl := client.NewController(*configPath, cfg)
+	if err := ctrl.Connect(); err != nil {
+		log.Fatalf("Failed to start client: %v", err)
 	}
 
-	// Initialize Transport
-	transport := client.NewTransport(cfg, pool)
+	// Metrics listener, when configured
+	if cfg.MetricsListen != "" {
+		go func() {
+			if err := http.ListenAndServe(cfg.MetricsListen, ctrl.Metrics()); err != nil {
+				log.Fatalf("Metrics listener failed: %v", err)
+			}
+		}()
+	}
 
-	// Initialize SOCKS5 Server
-	socks := client.NewSOCKS5Server(cfg.ProxyPort, transport)
+	// Control API, when configured
+	if cfg.Control.Listen != "" {
+		l, err := localapi.Listen(cfg.Control, "control")
+		if err != nil {
+			log.Fatalf("Failed to start control API: %v", err)
+		}
+		control := client.NewControlServer(ctrl, cfg.Control.Token)
+		go func() {
+			if err := http.Serve(l, control); err != nil {
+				log.Fatalf("Control API failed: %v", err)
+			}
+		}()
+	}
 
 	// Banner
 	banner.Print("CLIENT")
 	banner.PrintClientStatus(cfg.ProxyPort, cfg.Host, cfg.TLS)
+	slog.Info("SOCKS5 client started", "port", cfg.ProxyPort)
 
-	// Start
-	log.Printf("Starting SOCKS5 Client on port %d...", cfg.ProxyPort)
-	if err := socks.ListenAndServe(); err != nil {
-		log.Fatalf("SOCKS5 Server failed: %v", err)
+	// Run until interrupted
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+	slog.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ctrl.Disconnect(ctx); err != nil {
+		slog.Warn("client did not stop cleanly", "err", err)
 	}
 }
@@ -25,6 +25,33 @@ type ClientConfig struct {
 	Port      int      `json:"port"`
 	ProxyPort int      `json:"proxy_port"`
 	Secret    string   `json:"secret"`
+	User      string   `json:"user,omitempty"`
+
+	// Advanced TLS settings, edited in the profile file only.
+	PinSHA256 []string `json:"pin_sha256,omitempty"`
+	CAFile    string   `json:"ca_file,omitempty"`
+
+	// Local proxy exposure, edited in the profile file only.
+	ProxyBind  string   `json:"proxy_bind,omitempty"`
+	ProxyUser  string   `json:"proxy_user,omitempty"`
+	ProxyPass  string   `json:"proxy_pass,omitempty"`
+	ProxyAllow []string `json:"proxy_allow,omitempty"`
+
+	SOCKSOptimistic bool `json:"socks_optimistic,omitempty"`
+
+	// Mux defaults to on when absent from the profile.
+	Mux         *bool `json:"mux,omitempty"`
+	MuxSessions int   `json:"mux_sessions,omitempty"`
+
+	DownloadMode string `json:"download_mode,omitempty"`
+
+	Transport   string `json:"transport,omitempty"`
+	WSPath      string `json:"ws_path,omitempty"`
+	HTTPVersion string `json:"http_version,omitempty"`
+
+	Profile  *config.RequestProfile `json:"profile,omitempty"`
+	Routing  *config.Routing        `json:"routing,omitempty"`
+	LocalDNS *config.LocalDNS       `json:"local_dns,omitempty"`
 }
 
 // ProfilesStore is the top-level JSON structure for persistence
@@ -39,6 +66,7 @@ func (c ClientConfig) Normalize() (ClientConfig, error) {
 	cfg.Host = strings.TrimSpace(cfg.Host)
 	cfg.SNI = strings.TrimSpace(cfg.SNI)
 	cfg.Secret = strings.TrimSpace(cfg.Secret)
+	cfg.User = strings.TrimSpace(cfg.User)
 
 	addrs := make([]string, 0, len(cfg.Addresses))
 	for _, addr := range cfg.Addresses {
@@ -80,7 +108,7 @@ func (c ClientConfig) Validate() error {
 
 // ToInternal converts to pkg/config.Config
 func (c ClientConfig) ToInternal() config.Config {
-	return config.Config{
+	cfg := config.Config{
 		Addresses: c.Addresses,
 		Host:      c.Host,
 		TLS:       c.TLS,
@@ -88,7 +116,37 @@ func (c ClientConfig) ToInternal() config.Config {
 		Port:      c.Port,
 		ProxyPort: c.ProxyPort,
 		Secret:    c.Secret,
+		User:      c.User,
+
+		PinSHA256: c.PinSHA256,
+		CAFile:    c.CAFile,
+
+		ProxyBind:  c.ProxyBind,
+		ProxyUser:  c.ProxyUser,
+		ProxyPass:  c.ProxyPass,
+		ProxyAllow: c.ProxyAllow,
+
+		SOCKSOptimistic: c.SOCKSOptimistic,
+
+		Mux:         c.Mux == nil || *c.Mux,
+		MuxSessions: c.MuxSessions,
+
+		DownloadMode: c.DownloadMode,
+
+		Transport:   c.Transport,
+		WSPath:      c.WSPath,
+		HTTPVersion: c.HTTPVersion,
+	}
+	if c.Profile != nil {
+		cfg.Profile = *c.Profile
+	}
+	if c.Routing != nil {
+		cfg.Routing = *c.Routing
 	}
+	if c.LocalDNS != nil {
+		cfg.LocalDNS = *c.LocalDNS
+	}
+	return cfg
 }
 
 // ClientConfigFromInternal creates ClientConfig from pkg/config.Config
@@ -101,6 +159,30 @@ func ClientConfigFromInternal(c config.Config) ClientConfig {
 		Port:      c.Port,
 		ProxyPort: c.ProxyPort,
 		Secret:    c.Secret,
+		User:      c.User,
+
+		PinSHA256: c.PinSHA256,
+		CAFile:    c.CAFile,
+
+		ProxyBind:  c.ProxyBind,
+		ProxyUser:  c.ProxyUser,
+		ProxyPass:  c.ProxyPass,
+		ProxyAllow: c.ProxyAllow,
+
+		SOCKSOptimistic: c.SOCKSOptimistic,
+
+		Mux:         &c.Mux,
+		MuxSessions: c.MuxSessions,
+
+		DownloadMode: c.DownloadMode,
+
+		Transport:   c.Transport,
+		WSPath:      c.WSPath,
+		HTTPVersion: c.HTTPVersion,
+
+		Profile:  &c.Profile,
+		Routing:  &c.Routing,
+		LocalDNS: &c.LocalDNS,
 	}
 }
 
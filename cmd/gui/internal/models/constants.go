@@ -54,4 +54,8 @@ const (
 const (
 	TunHelperArg = "--fsak-tun-helper"
 	TunDevice    = "utun233"
+
+	// TunProxyAuthEnv passes "user:pass" for the local proxy to the helper
+	// without exposing it on the command line.
+	TunProxyAuthEnv = "FSAK_TUN_PROXY_AUTH"
 )
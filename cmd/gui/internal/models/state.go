@@ -45,6 +45,7 @@ type RunningClient struct {
 	Mode        ConnectionMode
 	Pool        *client.AddressPool
 	SOCKS       *client.SOCKS5Server
+	DNS         *client.DNSServer // nil unless local_dns is configured
 	SystemProxy client.SystemProxySession
 	Done        chan error
 	StartedAt   time.Time
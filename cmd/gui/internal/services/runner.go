@@ -9,6 +9,7 @@ import (
 
 	"github.com/paulGUZU/fsak/cmd/gui/internal/models"
 	"github.com/paulGUZU/fsak/internal/client"
+	"github.com/paulGUZU/fsak/pkg/tunnel"
 )
 
 // RunnerService manages the connection lifecycle
@@ -36,14 +37,42 @@ func (s *RunnerService) Start(opts StartOptions) error {
 
 	internalCfg := opts.Config.ToInternal()
 
+	tlsDialer, err := client.NewTLSDialer(&internalCfg)
+	if err != nil {
+		return fmt.Errorf("failed to configure TLS: %w", err)
+	}
+
+	httpVersion, err := client.HTTPVersion(&internalCfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	shape, err := tunnel.NewShape(&internalCfg)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	// Create address pool
-	pool, err := client.NewAddressPool(internalCfg.Addresses, internalCfg.Port, internalCfg.Host, internalCfg.TLS)
+	pool, err := client.NewAddressPool(internalCfg.Addresses, internalCfg.Port, internalCfg.Host, tlsDialer, httpVersion, shape)
 	if err != nil {
 		return fmt.Errorf("failed to create address pool: %w", err)
 	}
 
 	// Create transport and SOCKS server
 	transport := client.NewTransport(&internalCfg, pool)
+
+	// Local DNS server, when configured
+	var dnsServer *client.DNSServer
+	if internalCfg.LocalDNS.Listen != "" {
+		dnsServer, err = client.NewDNSServer(transport)
+		if err == nil {
+			err = dnsServer.Start()
+		}
+		if err != nil {
+			pool.Stop()
+			return fmt.Errorf("failed to start DNS server: %w", err)
+		}
+	}
+
 	socks := client.NewSOCKS5Server(internalCfg.ProxyPort, transport)
 	socksDone := make(chan error, 1)
 
@@ -54,6 +83,7 @@ func (s *RunnerService) Start(opts StartOptions) error {
 	// Wait for SOCKS to start
 	select {
 	case err := <-socksDone:
+		stopDNS(dnsServer)
 		pool.Stop()
 		if err == nil {
 			return errors.New("SOCKS server stopped unexpectedly")
@@ -72,15 +102,26 @@ func (s *RunnerService) Start(opts StartOptions) error {
 			ctx, cancel := context.WithTimeout(context.Background(), models.ConnectionTimeout)
 			defer cancel()
 			_ = socks.Stop(ctx)
+			stopDNS(dnsServer)
 			pool.Stop()
 			return errors.New("TUN mode is only supported on macOS")
 		}
 
-		tunSession, err := StartTUNSession(internalCfg.ProxyPort, "", internalCfg.Addresses)
+		// Server addresses given as host names are bypassed by the
+		// addresses the DNS server resolved them to, and the system is
+		// pointed at the DNS server while the session runs.
+		bypass := internalCfg.Addresses
+		var systemDNS string
+		if dnsServer != nil {
+			bypass = append(append([]string(nil), bypass...), dnsServer.BypassAddrs()...)
+			systemDNS = dnsServer.SystemAddr()
+		}
+		tunSession, err := StartTUNSession(internalCfg.ProxyPort, internalCfg.ProxyUser, internalCfg.ProxyPass, "", bypass, systemDNS)
 		if err != nil {
 			ctx, cancel := context.WithTimeout(context.Background(), models.ConnectionTimeout)
 			defer cancel()
 			_ = socks.Stop(ctx)
+			stopDNS(dnsServer)
 			pool.Stop()
 			return fmt.Errorf("failed to start TUN runtime: %w", err)
 		}
@@ -121,6 +162,7 @@ func (s *RunnerService) Start(opts StartOptions) error {
 		Mode:        opts.Mode,
 		Pool:        pool,
 		SOCKS:       socks,
+		DNS:         dnsServer,
 		SystemProxy: systemProxy,
 		Done:        done,
 		StartedAt:   time.Now(),
@@ -160,6 +202,8 @@ func (s *RunnerService) Stop() error {
 		}
 	}
 
+	stopDNS(runner.DNS)
+
 	// Stop address pool
 	if runner.Pool != nil {
 		runner.Pool.Stop()
@@ -185,6 +229,8 @@ func (s *RunnerService) ForceStop() error {
 		_ = runner.SOCKS.Stop(ctx)
 	}
 
+	stopDNS(runner.DNS)
+
 	if runner.Pool != nil {
 		runner.Pool.Stop()
 	}
@@ -193,6 +239,12 @@ func (s *RunnerService) ForceStop() error {
 	return nil
 }
 
+func stopDNS(d *client.DNSServer) {
+	if d != nil {
+		_ = d.Stop()
+	}
+}
+
 // Watch monitors the runner and handles disconnection
 func (s *RunnerService) Watch(onDisconnect func(error)) {
 	runner := s.state.Runner()
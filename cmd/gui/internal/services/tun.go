@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -84,8 +85,9 @@ func (b *cappedBuffer) String() string {
 	return string(b.buf)
 }
 
-// StartTUNSession starts a TUN session
-func StartTUNSession(proxyPort int, bindInterface string, bypassEntries []string) (*TUNSession, error) {
+// StartTUNSession starts a TUN session. When dnsServer is set the system
+// resolver is pointed at it for the duration of the session.
+func StartTUNSession(proxyPort int, proxyUser, proxyPass string, bindInterface string, bypassEntries []string, dnsServer string) (*TUNSession, error) {
 	if runtime.GOOS != "darwin" {
 		return nil, errors.New("TUN mode is only supported on macOS")
 	}
@@ -102,8 +104,14 @@ func StartTUNSession(proxyPort int, bindInterface string, bypassEntries []string
 	if len(bypassEntries) > 0 {
 		args = append(args, "--bypass", strings.Join(bypassEntries, ","))
 	}
+	if dnsServer != "" {
+		args = append(args, "--dns", dnsServer)
+	}
 
 	cmd := exec.Command(exePath, args...)
+	if proxyUser != "" || proxyPass != "" {
+		cmd.Env = append(os.Environ(), models.TunProxyAuthEnv+"="+proxyUser+":"+proxyPass)
+	}
 	logs := &cappedBuffer{max: models.MaxLogBuffer}
 	cmd.Stdout = logs
 	cmd.Stderr = logs
@@ -141,6 +149,17 @@ func StartTUNSession(proxyPort int, bindInterface string, bypassEntries []string
 	}, nil
 }
 
+// tunProxyURL points tun2socks at the local proxy, with the credentials
+// handed over by StartTUNSession when the proxy requires them.
+func tunProxyURL(proxyPort int) string {
+	u := &url.URL{Scheme: "socks5", Host: fmt.Sprintf("127.0.0.1:%d", proxyPort)}
+	if auth := os.Getenv(models.TunProxyAuthEnv); auth != "" {
+		user, pass, _ := strings.Cut(auth, ":")
+		u.User = url.UserPassword(user, pass)
+	}
+	return u.String()
+}
+
 // RunTUNHelper runs the TUN helper process (called with --fsak-tun-helper)
 func RunTUNHelper(args []string) error {
 	if runtime.GOOS != "darwin" {
@@ -151,6 +170,7 @@ func RunTUNHelper(args []string) error {
 	var tunDevice string
 	var bindInterface string
 	var bypassRaw string
+	var dnsServer string
 
 	// Parse flags
 	fs := createFlagSet()
@@ -158,6 +178,7 @@ func RunTUNHelper(args []string) error {
 	fs.StringVar(&tunDevice, "device", models.TunDevice, "TUN device name")
 	fs.StringVar(&bindInterface, "interface", "", "physical egress interface")
 	fs.StringVar(&bypassRaw, "bypass", "", "comma separated server IPs/CIDRs to bypass")
+	fs.StringVar(&dnsServer, "dns", "", "DNS server to use while the tunnel is up")
 
 	if err := fs.Parse(args); err != nil {
 		return err
@@ -184,7 +205,7 @@ func RunTUNHelper(args []string) error {
 	// Start tun2socks engine
 	key := &engine.Key{
 		MTU:       1500,
-		Proxy:     fmt.Sprintf("socks5://127.0.0.1:%d", proxyPort),
+		Proxy:     tunProxyURL(proxyPort),
 		Device:    tunDevice,
 		Interface: bindInterface,
 		LogLevel:  "warn",
@@ -200,6 +221,14 @@ func RunTUNHelper(args []string) error {
 	}
 	defer func() { _ = cleanup() }()
 
+	if dnsServer != "" {
+		restoreDNS, err := setDarwinDNS(bindInterface, dnsServer)
+		if err != nil {
+			return fmt.Errorf("failed to configure DNS: %w", err)
+		}
+		defer func() { _ = restoreDNS() }()
+	}
+
 	// Wait for signal
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
@@ -326,6 +355,49 @@ func setupDarwinTunnelRoutes(tunDevice string, defaultGateway string, bypassEntr
 	}, nil
 }
 
+// setDarwinDNS points the network service of iface at server and returns
+// a function restoring the previous servers.
+func setDarwinDNS(iface, server string) (func() error, error) {
+	service, err := darwinNetworkService(iface)
+	if err != nil {
+		return nil, err
+	}
+	out, err := runCommand("networksetup", "-getdnsservers", service)
+	if err != nil {
+		return nil, err
+	}
+	previous := []string{"Empty"}
+	if !strings.Contains(out, "aren't any") {
+		previous = strings.Fields(out)
+	}
+	if err := runCommandErr("networksetup", "-setdnsservers", service, server); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return runCommandErr("networksetup", append([]string{"-setdnsservers", service}, previous...)...)
+	}, nil
+}
+
+// darwinNetworkService finds the network service name of a device such as
+// en0 in the hardware port list.
+func darwinNetworkService(iface string) (string, error) {
+	out, err := runCommand("networksetup", "-listallhardwareports")
+	if err != nil {
+		return "", err
+	}
+	var port string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "Hardware Port:"); ok {
+			port = strings.TrimSpace(name)
+		}
+		if device, ok := strings.CutPrefix(line, "Device:"); ok && strings.TrimSpace(device) == iface && port != "" {
+			return port, nil
+		}
+	}
+	return "", fmt.Errorf("no network service for interface %s", iface)
+}
+
 func replaceDarwinSplitRoute(cidr string, tunDevice string) error {
 	_ = runCommandErr("route", "-n", "delete", "-net", cidr, "-interface", tunDevice)
 	if err := runCommandErr("route", "-n", "add", "-net", cidr, "-interface", tunDevice); err != nil {
@@ -31,6 +31,7 @@ type ProfileManager struct {
 	sni           *widget.Entry
 	port          *widget.Entry
 	proxyPort     *widget.Entry
+	user          *widget.Entry
 	secret        *widget.Entry
 
 	// Current profiles cache
@@ -98,6 +99,9 @@ func (pm *ProfileManager) setupUI() {
 	pm.proxyPort = widget.NewEntry()
 	pm.proxyPort.SetPlaceHolder("1080")
 
+	pm.user = widget.NewEntry()
+	pm.user.SetPlaceHolder("optional, for multi-user servers")
+
 	pm.secret = widget.NewPasswordEntry()
 	pm.secret.SetPlaceHolder("shared secret")
 
@@ -157,6 +161,9 @@ func (pm *ProfileManager) setupUI() {
 			),
 		),
 		
+		widget.NewLabelWithStyle("User ID", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		pm.user,
+
 		widget.NewLabelWithStyle("Shared Secret", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 		pm.secret,
 	)
@@ -303,6 +310,7 @@ func (pm *ProfileManager) fillForm(name string, cfg models.ClientConfig) {
 	pm.sni.SetText(cfg.SNI)
 	pm.port.SetText(fmt.Sprintf("%d", cfg.Port))
 	pm.proxyPort.SetText(fmt.Sprintf("%d", cfg.ProxyPort))
+	pm.user.SetText(cfg.User)
 	pm.secret.SetText(cfg.Secret)
 
 	pm.onTLSChanged(cfg.TLS)
@@ -316,6 +324,7 @@ func (pm *ProfileManager) clearForm() {
 	pm.sni.SetText("")
 	pm.port.SetText("80")
 	pm.proxyPort.SetText("1080")
+	pm.user.SetText("")
 	pm.secret.SetText("")
 	pm.onTLSChanged(false)
 }
@@ -338,15 +347,17 @@ func (pm *ProfileManager) readForm() (string, models.ClientConfig, error) {
 
 	addrs := models.ParseAddresses(pm.addresses.Text)
 
-	cfg := models.ClientConfig{
-		Addresses: addrs,
-		Host:      models.SanitizeString(pm.host.Text),
-		TLS:       pm.tls.Checked,
-		SNI:       models.SanitizeString(pm.sni.Text),
-		Port:      port,
-		ProxyPort: proxyPort,
-		Secret:    models.SanitizeString(pm.secret.Text),
-	}
+	// Start from the stored profile so settings without a form field survive
+	// a save.
+	cfg := pm.profiles[name]
+	cfg.Addresses = addrs
+	cfg.Host = models.SanitizeString(pm.host.Text)
+	cfg.TLS = pm.tls.Checked
+	cfg.SNI = models.SanitizeString(pm.sni.Text)
+	cfg.Port = port
+	cfg.ProxyPort = proxyPort
+	cfg.Secret = models.SanitizeString(pm.secret.Text)
+	cfg.User = models.SanitizeString(pm.user.Text)
 
 	normalized, err := cfg.Normalize()
 	if err != nil {
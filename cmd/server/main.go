@@ -1,16 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/paulGUZU/fsak/internal/server"
 	"github.com/paulGUZU/fsak/pkg/banner"
 	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/localapi"
+	"github.com/paulGUZU/fsak/pkg/logging"
+	"github.com/quic-go/quic-go/http3"
 )
 
+// serverStopTimeout bounds the wait for responses still being written once
+// the sessions are closed.
+const serverStopTimeout = 5 * time.Second
+
 func main() {
 	configPath := flag.String("config", "config.json", "path to config file")
 	flag.Parse()
@@ -19,6 +35,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if _, err := logging.Setup(cfg.Log, os.Stderr); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
 
 	// Override port if needed or just use logic
 	addr := fmt.Sprintf(":%d", cfg.Port)
@@ -26,13 +45,209 @@ func main() {
 		addr = ":8080"
 	}
 
-	handler := server.NewHandler(cfg)
+	handler, err := server.NewHandler(cfg)
+	if err != nil {
+		log.Fatalf("Failed to init handler: %v", err)
+	}
+
+	// Sockets passed by systemd or by the process this one replaces
+	sockets := server.InheritSockets()
+	var apis []*http.Server
+	var serve []func()
+
+	if cfg.MetricsListen != "" {
+		l, err := sockets.Listener("metrics", func() (net.Listener, error) {
+			return net.Listen("tcp", cfg.MetricsListen)
+		})
+		if err != nil {
+			log.Fatalf("Failed to start metrics listener: %v", err)
+		}
+		srv := &http.Server{Handler: handler.Metrics()}
+		apis = append(apis, srv)
+		serve = append(serve, func() { serveAPI(srv, l, "Metrics listener") })
+	}
+
+	if cfg.Admin.Listen != "" {
+		l, err := sockets.Listener("admin", func() (net.Listener, error) {
+			return localapi.Listen(cfg.Admin, "admin")
+		})
+		if err != nil {
+			log.Fatalf("Failed to start admin API: %v", err)
+		}
+		admin := server.NewAdminServer(handler, cfg.Admin.Token, func() (*config.Config, error) {
+			return config.LoadConfig(*configPath)
+		})
+		srv := &http.Server{Handler: admin}
+		apis = append(apis, srv)
+		serve = append(serve, func() { serveAPI(srv, l, "Admin API") })
+	}
+
+	tlsConfig, reloader, err := server.NewTLSConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to init TLS: %v", err)
+	}
+	if reloader != nil {
+		go reloader.Watch()
+		go reloadOnSIGHUP(reloader)
+	}
+
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		Protocols: new(http.Protocols),
+	}
+	// HTTP/2 is negotiated through ALPN with TLS and accepted as h2c
+	// without, for setups behind a local reverse proxy.
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	var h3 *http3.Server
+	if cfg.HTTP3 {
+		if tlsConfig == nil {
+			log.Fatalf("http3 requires cert_file and key_file or self_signed")
+		}
+		pc, err := sockets.PacketConn("http3", func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", addr)
+		})
+		if err != nil {
+			log.Fatalf("HTTP/3 server failed: %v", err)
+		}
+		h3 = server.NewHTTP3Server(addr, handler, tlsConfig)
+		serve = append(serve, func() {
+			if err := h3.Serve(pc); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP/3 server failed: %v", err)
+			}
+		})
+	}
+
+	l, err := sockets.Listener("http", func() (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})
+	if err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	serve = append(serve, func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ServeTLS(l, "", "")
+		} else {
+			err = srv.Serve(l)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	})
+
+	// The process this one replaces keeps its sessions; learn which they
+	// are before serving, so their requests are passed on to it
+	if err := server.NotifyReady(); err != nil {
+		slog.Warn("failed to notify the previous process", "err", err)
+	}
+	if state := server.InheritedState(); state != nil {
+		if err := handler.ForwardSessions(state); err != nil {
+			slog.Warn("failed to read the previous process's sessions", "err", err)
+		}
+		_ = state.Close()
+	}
+	for _, fn := range serve {
+		go fn()
+	}
 
 	// Banner
 	banner.Print("SERVER")
-	banner.PrintServerStatus(addr)
-	
-	if err := http.ListenAndServe(addr, handler); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	banner.PrintServerStatus(addr, tlsConfig != nil)
+
+	// Run until SIGTERM, or until a new process has taken the sockets over
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, os.Interrupt, syscall.SIGTERM)
+	handoffCh := make(chan os.Signal, 1)
+	server.NotifyHandoff(handoffCh)
+	var forward *http.Server
+	srvStopped := make(chan error, 1)
+	handedOff := false
+	for running := true; running; {
+		select {
+		case sig := <-stopCh:
+			slog.Info("shutting down", "signal", sig.String())
+			running = false
+		case <-handoffCh:
+			proc, err := sockets.Handoff(func(w io.Writer) error {
+				// Everything new goes to the new process from here on:
+				// the listener closes, idle connections close and
+				// HTTP/2 ones are told to go away. Requests for the
+				// sessions kept here come back through the new process.
+				go func() { srvStopped <- srv.Shutdown(context.Background()) }()
+				if h3 != nil {
+					go func() { _ = h3.Shutdown(context.Background()) }()
+				}
+				var err error
+				forward, err = handler.ServeHandoff(w)
+				return err
+			})
+			if proc == nil {
+				slog.Error("socket handoff failed", "err", err)
+				continue
+			}
+			if err != nil {
+				slog.Warn("socket handoff incomplete", "err", err)
+			}
+			slog.Info("sockets handed off, shutting down", "pid", proc.Pid)
+			handedOff, running = true, false
+		}
+	}
+
+	// Refuse new sessions and keep serving the existing ones until they
+	// end or the timeout passes, then close the rest and the servers
+	handler.Drain()
+	for _, api := range apis {
+		_ = api.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), handler.ShutdownTimeout())
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		slog.Warn("sessions did not drain", "err", err)
+	}
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), serverStopTimeout)
+	defer stopCancel()
+	if handedOff {
+		select {
+		case err = <-srvStopped:
+		case <-stopCtx.Done():
+			err = stopCtx.Err()
+		}
+	} else {
+		err = srv.Shutdown(stopCtx)
+	}
+	if err != nil {
+		slog.Warn("requests still running at shutdown", "err", err)
+	}
+	if h3 != nil {
+		_ = h3.Shutdown(stopCtx)
+	}
+	if forward != nil {
+		_ = forward.Shutdown(stopCtx)
+	}
+}
+
+// serveAPI serves srv on l. Errors other than the server being closed are
+// fatal; name is what they are reported as.
+func serveAPI(srv *http.Server, l net.Listener, name string) {
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("%s failed: %v", name, err)
+	}
+}
+
+func reloadOnSIGHUP(reloader *server.CertReloader) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := reloader.Reload(); err != nil {
+			slog.Error("certificate reload failed", "err", err)
+			continue
+		}
+		slog.Info("certificate reloaded")
 	}
 }
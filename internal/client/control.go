@@ -0,0 +1,340 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/localapi"
+)
+
+// controlStopTimeout bounds how long a reconnect or profile switch waits
+// for the proxy's connections to wind down.
+const controlStopTimeout = 5 * time.Second
+
+// Controller keeps the client running for the control API and replaces the
+// running Instance on reconnects and profile switches.
+type Controller struct {
+	logger *slog.Logger
+	op     sync.Mutex // held while the client starts or stops
+
+	mu   sync.Mutex
+	path string         // config file of the current profile
+	cfg  *config.Config // loaded from path
+	inst *Instance      // nil while disconnected
+}
+
+// NewController manages a client for cfg, which was loaded from path. It
+// starts disconnected.
+func NewController(path string, cfg *config.Config) *Controller {
+	return &Controller{logger: slog.Default(), path: path, cfg: cfg}
+}
+
+func (c *Controller) state() (path string, cfg *config.Config, inst *Instance) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.path, c.cfg, c.inst
+}
+
+// Instance returns the running client, or nil while disconnected.
+func (c *Controller) Instance() *Instance {
+	_, _, inst := c.state()
+	return inst
+}
+
+// Connect starts the client with the current profile unless it runs.
+func (c *Controller) Connect() error {
+	c.op.Lock()
+	defer c.op.Unlock()
+	_, cfg, inst := c.state()
+	if inst != nil {
+		return nil
+	}
+	return c.start(cfg)
+}
+
+// Disconnect stops the client, closing every proxied connection.
+func (c *Controller) Disconnect(ctx context.Context) error {
+	c.op.Lock()
+	defer c.op.Unlock()
+	return c.stop(ctx)
+}
+
+// Reconnect restarts the client with the current profile: the address
+// pool probes from scratch and every tunnel session is opened anew.
+func (c *Controller) Reconnect() error {
+	c.op.Lock()
+	defer c.op.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), controlStopTimeout)
+	defer cancel()
+	if err := c.stop(ctx); err != nil {
+		c.logger.Warn("client did not stop cleanly", "err", err)
+	}
+	_, cfg, _ := c.state()
+	return c.start(cfg)
+}
+
+// Switch makes cfg, loaded from path, the current profile and starts the
+// client with it. When that fails the previous profile is restored.
+func (c *Controller) Switch(path string, cfg *config.Config) error {
+	c.op.Lock()
+	defer c.op.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), controlStopTimeout)
+	defer cancel()
+	_, prev, running := c.state()
+	if err := c.stop(ctx); err != nil {
+		c.logger.Warn("client did not stop cleanly", "err", err)
+	}
+
+	err := c.start(cfg)
+	if err != nil {
+		if running == nil {
+			return err
+		}
+		if restoreErr := c.start(prev); restoreErr != nil {
+			c.logger.Error("previous profile failed to restart", "err", restoreErr)
+		}
+		return err
+	}
+	c.mu.Lock()
+	c.path, c.cfg = path, cfg
+	c.mu.Unlock()
+	c.logger.Info("profile switched", "profile", profileName(path))
+	return nil
+}
+
+func (c *Controller) start(cfg *config.Config) error {
+	inst, err := StartInstance(cfg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.inst = inst
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Controller) stop(ctx context.Context) error {
+	c.mu.Lock()
+	inst := c.inst
+	c.inst = nil
+	c.mu.Unlock()
+	if inst == nil {
+		return nil
+	}
+	return inst.Stop(ctx)
+}
+
+// Metrics serves the metrics of whichever client runs; they start over
+// with each reconnect.
+func (c *Controller) Metrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inst := c.Instance()
+		if inst == nil {
+			http.Error(w, "client is disconnected", http.StatusServiceUnavailable)
+			return
+		}
+		inst.Transport.Metrics().ServeHTTP(w, r)
+	})
+}
+
+// profileName is the name a profile's config file goes by.
+func profileName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// profilePath resolves a profile for a switch: a bare name is the
+// "<name>.json" next to the current profile's file, anything else a path.
+func profilePath(current, profile string) string {
+	if filepath.Base(profile) == profile && filepath.Ext(profile) == "" {
+		return filepath.Join(filepath.Dir(current), profile+".json")
+	}
+	return profile
+}
+
+// controlStatus is what GET /status reports.
+type controlStatus struct {
+	Connected     bool         `json:"connected"`
+	Profile       string       `json:"profile"`
+	Config        string       `json:"config"`
+	Server        string       `json:"server"`
+	Proxy         string       `json:"proxy,omitempty"`
+	StartedAt     time.Time    `json:"started_at,omitzero"`
+	UptimeSeconds float64      `json:"uptime_seconds,omitempty"`
+	BestAddress   *addressInfo `json:"best_address,omitempty"`
+	Tunnels       int          `json:"tunnels"`
+	Traffic       *trafficInfo `json:"traffic,omitempty"`
+}
+
+type addressInfo struct {
+	Address           string    `json:"address"`
+	Healthy           bool      `json:"healthy"`
+	Quality           float64   `json:"quality"`
+	TCPLatencySeconds float64   `json:"tcp_latency_seconds"`
+	AppLatencySeconds float64   `json:"app_latency_seconds"`
+	Fails             int       `json:"fails"`
+	LastCheck         time.Time `json:"last_check,omitzero"`
+}
+
+func newAddressInfo(s IPStats) addressInfo {
+	return addressInfo{
+		Address:           s.IP,
+		Healthy:           s.Healthy,
+		Quality:           s.Quality,
+		TCPLatencySeconds: s.TCPLatency.Seconds(),
+		AppLatencySeconds: s.AppLatency.Seconds(),
+		Fails:             s.Fails,
+		LastCheck:         s.LastCheck,
+	}
+}
+
+type trafficInfo struct {
+	Up          int64 `json:"up"`
+	Down        int64 `json:"down"`
+	PaddingUp   int64 `json:"padding_up"`
+	PaddingDown int64 `json:"padding_down"`
+}
+
+func (c *Controller) status(now time.Time) controlStatus {
+	path, cfg, inst := c.state()
+	st := controlStatus{
+		Profile: profileName(path),
+		Config:  path,
+		Server:  cfg.Host,
+	}
+	if inst == nil {
+		return st
+	}
+	st.Connected = true
+	st.Proxy = inst.SOCKS.addr
+	st.StartedAt = inst.StartedAt
+	st.UptimeSeconds = now.Sub(inst.StartedAt).Seconds()
+	if best, ok := inst.Pool.Best(); ok {
+		info := newAddressInfo(best)
+		st.BestAddress = &info
+	}
+	st.Tunnels = len(inst.SOCKS.tunnelInfos(now))
+	stats := inst.Transport.Stats()
+	st.Traffic = &trafficInfo{
+		Up:          stats.Up,
+		Down:        stats.Down,
+		PaddingUp:   stats.PaddingUp,
+		PaddingDown: stats.PaddingDown,
+	}
+	return st
+}
+
+// ControlServer is the client's control API: it reports status, the
+// address pool and open tunnels, and connects, disconnects, reconnects or
+// switches profiles.
+type ControlServer struct {
+	ctrl *Controller
+	mux  http.Handler
+}
+
+// NewControlServer serves the API for c. Requests must present token
+// unless it is empty.
+func NewControlServer(c *Controller, token string) *ControlServer {
+	s := &ControlServer{ctrl: c}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", s.getStatus)
+	mux.HandleFunc("GET /pool", s.listPool)
+	mux.HandleFunc("GET /tunnels", s.listTunnels)
+	mux.HandleFunc("DELETE /tunnels/{id}", s.closeTunnel)
+	mux.HandleFunc("POST /connect", s.connect)
+	mux.HandleFunc("POST /disconnect", s.disconnect)
+	mux.HandleFunc("POST /reconnect", s.reconnect)
+	mux.HandleFunc("POST /profile", s.switchProfile)
+	s.mux = localapi.RequireToken(token, mux)
+	return s
+}
+
+func (s *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *ControlServer) getStatus(w http.ResponseWriter, _ *http.Request) {
+	localapi.WriteJSON(w, http.StatusOK, s.ctrl.status(time.Now()))
+}
+
+func (s *ControlServer) listPool(w http.ResponseWriter, _ *http.Request) {
+	addrs := []addressInfo{}
+	if inst := s.ctrl.Instance(); inst != nil {
+		for _, stats := range inst.Pool.snapshot() {
+			addrs = append(addrs, newAddressInfo(stats))
+		}
+	}
+	localapi.WriteJSON(w, http.StatusOK, addrs)
+}
+
+func (s *ControlServer) listTunnels(w http.ResponseWriter, _ *http.Request) {
+	tunnels := []tunnelInfo{}
+	if inst := s.ctrl.Instance(); inst != nil {
+		tunnels = inst.SOCKS.tunnelInfos(time.Now())
+	}
+	localapi.WriteJSON(w, http.StatusOK, tunnels)
+}
+
+func (s *ControlServer) closeTunnel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	inst := s.ctrl.Instance()
+	if err != nil || inst == nil || !inst.SOCKS.closeTunnelID(id) {
+		localapi.WriteError(w, http.StatusNotFound, errors.New("no such tunnel"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ControlServer) connect(w http.ResponseWriter, _ *http.Request) {
+	s.reply(w, s.ctrl.Connect())
+}
+
+func (s *ControlServer) disconnect(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), controlStopTimeout)
+	defer cancel()
+	s.reply(w, s.ctrl.Disconnect(ctx))
+}
+
+func (s *ControlServer) reconnect(w http.ResponseWriter, _ *http.Request) {
+	s.reply(w, s.ctrl.Reconnect())
+}
+
+type profileRequest struct {
+	Profile string `json:"profile"`
+}
+
+func (s *ControlServer) switchProfile(w http.ResponseWriter, r *http.Request) {
+	var req profileRequest
+	if err := localapi.ReadJSON(r, &req); err != nil {
+		localapi.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.Profile) == "" {
+		localapi.WriteError(w, http.StatusBadRequest, errors.New("profile is required"))
+		return
+	}
+	current, _, _ := s.ctrl.state()
+	path := profilePath(current, req.Profile)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		localapi.WriteError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	s.reply(w, s.ctrl.Switch(path, cfg))
+}
+
+// reply answers a state change with the resulting status, or its error.
+func (s *ControlServer) reply(w http.ResponseWriter, err error) {
+	if err != nil {
+		localapi.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	localapi.WriteJSON(w, http.StatusOK, s.ctrl.status(time.Now()))
+}
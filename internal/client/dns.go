@@ -0,0 +1,587 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSUpstream  = "1.1.1.1:53"
+	defaultFakeIPRange  = "198.19.0.0/16"
+	defaultDNSCacheSize = 4096
+
+	dnsQueryTimeout = 5 * time.Second
+	// fakeIPTTL is the TTL of fake and server address answers; the
+	// mappings themselves live until the range wraps around.
+	fakeIPTTL = 60
+	// negativeDNSTTL is how long answers without records are cached.
+	negativeDNSTTL = 30 * time.Second
+	maxDNSMessage  = 65535
+)
+
+// Service binding record types (RFC 9460), which carry address hints.
+const (
+	dnsTypeSVCB  dnsmessage.Type = 64
+	dnsTypeHTTPS dnsmessage.Type = 65
+)
+
+// errFakeIPUnknown is returned for fake addresses that no longer map to a
+// name, typically after a restart.
+var errFakeIPUnknown = errors.New("unknown fake IP")
+
+// DNSServer answers DNS queries on a local address by forwarding them
+// through the tunnel. The server's own host names are answered from
+// addresses resolved at start, so the client keeps reaching the server once
+// the system uses this resolver.
+type DNSServer struct {
+	transport *Transport
+	listen    string
+	upstream  string
+	cache     *dnsCache   // nil when disabled
+	fake      *fakeIPPool // nil unless fake-IP mode is on
+
+	mu     sync.Mutex
+	static map[string][]netip.Addr
+	udp    net.PacketConn
+	tcp    net.Listener
+	wg     sync.WaitGroup
+}
+
+// NewDNSServer validates the local_dns section of the transport's config.
+func NewDNSServer(t *Transport) (*DNSServer, error) {
+	cfg := t.Config.LocalDNS
+	if strings.TrimSpace(cfg.Listen) == "" {
+		return nil, errors.New("local_dns.listen is not set")
+	}
+	d := &DNSServer{
+		transport: t,
+		listen:    strings.TrimSpace(cfg.Listen),
+		upstream:  withDefaultPort(orDefault(cfg.Upstream, defaultDNSUpstream), "53"),
+	}
+	if _, _, err := net.SplitHostPort(d.listen); err != nil {
+		return nil, fmt.Errorf("local_dns.listen: %w", err)
+	}
+	size := cfg.CacheSize
+	if size == 0 {
+		size = defaultDNSCacheSize
+	}
+	if size > 0 {
+		d.cache = newDNSCache(size)
+	}
+	if cfg.FakeIP {
+		prefix, err := netip.ParsePrefix(orDefault(cfg.FakeIPRange, defaultFakeIPRange))
+		if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+			return nil, fmt.Errorf("local_dns.fake_ip_range must be an IPv4 CIDR of at least /30")
+		}
+		d.fake = newFakeIPPool(prefix.Masked())
+	}
+	return d, nil
+}
+
+func orDefault(v, def string) string {
+	if v = strings.TrimSpace(v); v != "" {
+		return v
+	}
+	return def
+}
+
+// Start resolves the server addresses and starts serving on UDP and TCP.
+func (d *DNSServer) Start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.udp != nil {
+		return errors.New("DNS server already running")
+	}
+
+	d.static = make(map[string][]netip.Addr)
+	for _, addr := range d.transport.Config.Addresses {
+		host := normalizeDomain(addr)
+		if _, err := netip.ParsePrefix(host); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("resolve server address %s: %w", host, err)
+		}
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+		d.static[host] = addrs
+	}
+
+	udp, err := net.ListenPacket("udp", d.listen)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", d.listen)
+	if err != nil {
+		_ = udp.Close()
+		return err
+	}
+	d.udp, d.tcp = udp, tcp
+	d.transport.dns.Store(d)
+
+	d.transport.logger.Info("DNS server listening", "addr", d.listen, "upstream", d.upstream)
+	d.wg.Add(2)
+	go d.serveUDP(udp)
+	go d.serveTCP(tcp)
+	return nil
+}
+
+// Stop closes the listeners and waits for the serving loops to end.
+func (d *DNSServer) Stop() error {
+	d.mu.Lock()
+	if d.udp == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	d.transport.dns.CompareAndSwap(d, nil)
+	err := errors.Join(d.udp.Close(), d.tcp.Close())
+	d.udp, d.tcp = nil, nil
+	d.mu.Unlock()
+	d.wg.Wait()
+	return err
+}
+
+// BypassAddrs returns the resolved server addresses given as host names,
+// which must stay outside a TUN device like the literal ones.
+func (d *DNSServer) BypassAddrs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []string
+	for _, addrs := range d.static {
+		for _, addr := range addrs {
+			out = append(out, addr.String())
+		}
+	}
+	return out
+}
+
+// SystemAddr returns the listen IP when the server is on port 53, where
+// an operating system can be pointed at it, and "" otherwise.
+func (d *DNSServer) SystemAddr() string {
+	host, port, err := net.SplitHostPort(d.listen)
+	if err != nil || port != "53" {
+		return ""
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+func (d *DNSServer) serveUDP(conn net.PacketConn) {
+	defer d.wg.Done()
+	buf := make([]byte, maxDNSMessage)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := d.answer(query)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(resp, from)
+		}()
+	}
+}
+
+func (d *DNSServer) serveTCP(l net.Listener) {
+	defer d.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go d.serveDNSConn(conn)
+	}
+}
+
+// serveDNSConn answers length-prefixed queries until the client closes
+// the connection or stays idle.
+func (d *DNSServer) serveDNSConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		query, err := readDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		resp, err := d.answer(query)
+		if err != nil {
+			return
+		}
+		if err := writeDNSMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSMessage(w io.Writer, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// answer builds the response to one query: from the server addresses,
+// the fake-IP pool, the cache, or the upstream through the tunnel.
+func (d *DNSServer) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := normalizeDomain(q.Name.String())
+
+	d.mu.Lock()
+	static, isServer := d.static[name]
+	d.mu.Unlock()
+	switch {
+	case isServer && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA):
+		return synthesizeDNS(h, q, static)
+	case d.fake != nil && !isServer && q.Class == dnsmessage.ClassINET:
+		switch q.Type {
+		case dnsmessage.TypeA:
+			return synthesizeDNS(h, q, []netip.Addr{d.fake.addrFor(name)})
+		case dnsmessage.TypeAAAA, dnsTypeSVCB, dnsTypeHTTPS:
+			// Only IPv4 fakes are handed out; real IPv6 or hint records
+			// would let clients skip the name mapping.
+			return synthesizeDNS(h, q, nil)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+	defer cancel()
+	return d.forward(ctx, query, h.ID, q)
+}
+
+// forward answers from the cache or asks the upstream, rewriting the ID to
+// match the query.
+func (d *DNSServer) forward(ctx context.Context, query []byte, id uint16, q dnsmessage.Question) ([]byte, error) {
+	key := cacheKey(q)
+	if d.cache != nil {
+		if resp, ok := d.cache.get(key, id, time.Now()); ok {
+			return resp, nil
+		}
+	}
+	resp, err := d.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if d.cache != nil {
+		d.cache.put(key, resp, time.Now())
+	}
+	return resp, nil
+}
+
+// exchange sends query to the upstream over a tunneled TCP connection.
+func (d *DNSServer) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		if err := d.transport.Tunnel(d.upstream, remote); err != nil {
+			d.transport.logger.Warn("DNS tunnel failed", "upstream", d.upstream, "err", err)
+		}
+		_ = remote.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = local.SetDeadline(deadline)
+	}
+	if err := writeDNSMessage(local, query); err != nil {
+		return nil, err
+	}
+	return readDNSMessage(local)
+}
+
+// LookupHost resolves host through the upstream, bypassing the fake-IP
+// pool, for connections that must reach the real address.
+func (d *DNSServer) LookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = normalizeDomain(host)
+	d.mu.Lock()
+	static, ok := d.static[host]
+	d.mu.Unlock()
+	if ok {
+		return static, nil
+	}
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: "invalid host name", Name: host, IsNotFound: true}
+	}
+
+	var addrs []netip.Addr
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		q := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+		msg := dnsmessage.Message{Header: dnsmessage.Header{RecursionDesired: true}, Questions: []dnsmessage.Question{q}}
+		query, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.forward(ctx, query, 0, q)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(resp); err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range m.Answers {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(body.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		msg := "no such host"
+		if lastErr != nil {
+			msg = lastErr.Error()
+		}
+		return nil, &net.DNSError{Err: msg, Name: host, IsNotFound: lastErr == nil}
+	}
+	return addrs, nil
+}
+
+// synthesizeDNS answers q with addrs of the queried family. No addresses
+// yield an empty NOERROR response.
+func synthesizeDNS(h dnsmessage.Header, q dnsmessage.Question, addrs []netip.Addr) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	for _, addr := range addrs {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: fakeIPTTL}
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6() && !addr.Is4In6():
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return msg.Pack()
+}
+
+func cacheKey(q dnsmessage.Question) string {
+	return strings.ToLower(q.Name.String()) + "/" + q.Type.String() + "/" + q.Class.String()
+}
+
+type dnsCacheEntry struct {
+	resp    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps upstream responses until their smallest TTL runs out and
+// hands them out with the TTLs reduced by the time spent in the cache.
+type dnsCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache(max int) *dnsCache {
+	return &dnsCache{max: max, entries: make(map[string]dnsCacheEntry)}
+}
+
+func (c *dnsCache) get(key string, id uint16, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && now.After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(e.resp); err != nil {
+		return nil, false
+	}
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			if section[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			section[i].Header.TTL -= min(section[i].Header.TTL, elapsed)
+		}
+	}
+	msg.Header.ID = id
+	resp, err := msg.Pack()
+	return resp, err == nil
+}
+
+func (c *dnsCache) put(key string, resp []byte, now time.Time) {
+	ttl, ok := responseTTL(resp)
+	if !ok || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dnsCacheEntry{resp: resp, stored: now, expires: now.Add(ttl)}
+}
+
+// responseTTL reports how long resp may be cached: the smallest answer
+// TTL, or negativeDNSTTL for successful and NXDOMAIN responses without
+// answers. Other failures are not cached.
+func responseTTL(resp []byte) (time.Duration, bool) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.Truncated {
+		return 0, false
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	if len(msg.Answers) == 0 {
+		return negativeDNSTTL, true
+	}
+	ttl := msg.Answers[0].Header.TTL
+	for _, rr := range msg.Answers[1:] {
+		ttl = min(ttl, rr.Header.TTL)
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+// fakeIPPool hands out addresses from a private range, one per name, and
+// maps them back. Once the range is used up the oldest mapping is reused.
+type fakeIPPool struct {
+	prefix netip.Prefix
+
+	mu     sync.Mutex
+	next   netip.Addr
+	byName map[string]netip.Addr
+	byAddr map[netip.Addr]string
+}
+
+func newFakeIPPool(prefix netip.Prefix) *fakeIPPool {
+	return &fakeIPPool{
+		prefix: prefix,
+		next:   prefix.Addr().Next(),
+		byName: make(map[string]netip.Addr),
+		byAddr: make(map[netip.Addr]string),
+	}
+}
+
+func (p *fakeIPPool) addrFor(name string) netip.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if addr, ok := p.byName[name]; ok {
+		return addr
+	}
+	addr := p.next
+	p.next = addr.Next()
+	if !p.prefix.Contains(p.next.Next()) {
+		// Skip the network and broadcast addresses on wrap-around.
+		p.next = p.prefix.Addr().Next()
+	}
+	if old, ok := p.byAddr[addr]; ok {
+		delete(p.byName, old)
+	}
+	p.byName[name] = addr
+	p.byAddr[addr] = name
+	return addr
+}
+
+// lookup returns the name behind addr. ok is false when addr is outside
+// the range; name is empty when it is inside but unassigned.
+func (p *fakeIPPool) lookup(addr netip.Addr) (name string, ok bool) {
+	if !p.prefix.Contains(addr) {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.byAddr[addr], true
+}
+
+// realTarget maps a target ("host:port") whose host is a fake IP from the
+// local DNS server back to the name it stands for.
+func (t *Transport) realTarget(target string) (string, error) {
+	d := t.dns.Load()
+	if d == nil || d.fake == nil {
+		return target, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target, nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return target, nil
+	}
+	name, inRange := d.fake.lookup(addr.Unmap())
+	if !inRange {
+		return target, nil
+	}
+	if name == "" {
+		return "", errFakeIPUnknown
+	}
+	return net.JoinHostPort(name, port), nil
+}
+
+// lookupHost resolves host for direct connections and routing: through
+// the local DNS server's upstream when it runs, so neither fake addresses
+// nor the system resolver get in the way, otherwise with the system.
+func (t *Transport) lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if d := t.dns.Load(); d != nil {
+		return d.LookupHost(ctx, host)
+	}
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Transport carries tunnel requests over QUIC. Each connection gets
+// its own UDP socket so the outbound interface binding applies to it.
+func newHTTP3Transport(outboundInterface string, tlsDialer *TLSDialer) *http3.Transport {
+	control := interfaceDialerControl(strings.TrimSpace(outboundInterface))
+	return &http3.Transport{
+		TLSClientConfig: tlsDialer.QUICConfig(""),
+		QUICConfig: &quic.Config{
+			KeepAlivePeriod: 15 * time.Second,
+		},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, quicCfg *quic.Config) (*quic.Conn, error) {
+			raddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			lc := net.ListenConfig{Control: control}
+			pconn, err := lc.ListenPacket(ctx, "udp", ":0")
+			if err != nil {
+				return nil, err
+			}
+			conn, err := quic.DialEarly(ctx, pconn, raddr, tlsCfg, quicCfg)
+			if err != nil {
+				_ = pconn.Close()
+				return nil, err
+			}
+			go func() {
+				<-conn.Context().Done()
+				_ = pconn.Close()
+			}()
+			return conn, nil
+		},
+	}
+}
+
+func probeEndpointHTTP3(ip string, port int, host string, tlsDialer *TLSDialer, shape *tunnel.Shape) (tcpLatency, appLatency time.Duration, ok bool) {
+	timeout := 2 * time.Second
+	address := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := quic.DialAddr(ctx, address, tlsDialer.QUICConfig(ip), nil)
+	if err != nil {
+		return 0, 0, false
+	}
+	tcpLatency = time.Since(start)
+	defer conn.CloseWithError(0, "")
+
+	req := probeRequest(ctx, shape, "https://"+address, ip, host)
+
+	startApp := time.Now()
+	resp, err := (&http3.Transport{}).NewClientConn(conn).RoundTrip(req)
+	if err != nil {
+		return tcpLatency, 0, false
+	}
+	resp.Body.Close()
+
+	appLatency = time.Since(startApp)
+	return tcpLatency, appLatency, true
+}
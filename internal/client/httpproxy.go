@@ -0,0 +1,211 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// bufferedConn is a net.Conn whose reads go through the reader used to
+// sniff the protocol, so no peeked bytes are lost.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// handleHTTP serves one HTTP proxy request on a connection that did not
+// start with the SOCKS5 version byte. CONNECT requests become a raw tunnel;
+// absolute-URI requests are forwarded to the origin with Connection: close,
+// so a client reconnects for each request and may switch hosts freely.
+func (s *SOCKS5Server) handleHTTP(conn net.Conn, br *bufio.Reader) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if !s.checkProxyAuth(req) {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"fsak\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		target := withDefaultPort(req.Host, "443")
+		s.connect(target, &bufferedConn{Conn: conn, r: br}, func(dialErr error) error {
+			if dialErr != nil {
+				return writeHTTPError(conn, dialErr)
+			}
+			_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return err
+		})
+		return
+	}
+
+	if req.URL.Host == "" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	target := withDefaultPort(req.URL.Host, "80")
+
+	// The request is re-serialized in origin form and is all that goes to
+	// the tunnel; the response tells the client to close afterwards.
+	req.RequestURI = ""
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Close = true
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(req.Write(pw))
+	}()
+	defer pr.Close()
+
+	s.connect(target, &singleRequestConn{Conn: conn, req: pr, rest: br}, func(dialErr error) error {
+		if dialErr != nil {
+			return writeHTTPError(conn, dialErr)
+		}
+		return nil
+	})
+}
+
+// maxResponseHeader bounds how much of a forwarded response is held back
+// to rewrite its header; longer headers pass through unchanged.
+const maxResponseHeader = 64 << 10
+
+// singleRequestConn carries one forwarded request and its response. Reads
+// return the request and then nothing more: later requests on a keep-alive
+// connection may be for another host, so they are discarded until the
+// client closes. Writes rewrite the response header to Connection: close.
+type singleRequestConn struct {
+	net.Conn
+	req    io.Reader
+	rest   io.Reader
+	header []byte // response bytes held back until the header is complete
+	done   bool   // the final response header has been written
+}
+
+func (c *singleRequestConn) Read(p []byte) (int, error) {
+	n, err := c.req.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	if _, err = io.Copy(io.Discard, c.rest); err == nil {
+		err = io.EOF
+	}
+	return 0, err
+}
+
+func (c *singleRequestConn) Write(p []byte) (int, error) {
+	if c.done {
+		return c.Conn.Write(p)
+	}
+	c.header = append(c.header, p...)
+	for !c.done {
+		end := bytes.Index(c.header, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(c.header) < maxResponseHeader {
+				return len(p), nil
+			}
+			c.done = true
+			break
+		}
+		head := c.header[:end+4]
+		// Interim 1xx responses come before the final one and pass as is.
+		if !bytes.HasPrefix(head[bytes.IndexByte(head, ' ')+1:], []byte("1")) {
+			head = closeResponseHeader(head)
+			c.done = true
+		}
+		if _, err := c.Conn.Write(head); err != nil {
+			return 0, err
+		}
+		c.header = c.header[end+4:]
+	}
+	if len(c.header) > 0 {
+		if _, err := c.Conn.Write(c.header); err != nil {
+			return 0, err
+		}
+	}
+	c.header = nil
+	return len(p), nil
+}
+
+// closeResponseHeader replaces the connection headers of a raw response
+// header with Connection: close.
+func closeResponseHeader(head []byte) []byte {
+	lines := strings.Split(strings.TrimSuffix(string(head), "\r\n\r\n"), "\r\n")
+	var b strings.Builder
+	b.WriteString(lines[0])
+	b.WriteString("\r\n")
+	for _, line := range lines[1:] {
+		name, _, _ := strings.Cut(line, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "connection", "keep-alive", "proxy-connection":
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("Connection: close\r\n\r\n")
+	return []byte(b.String())
+}
+
+// checkProxyAuth validates Basic Proxy-Authorization against the same
+// credentials as SOCKS5 authentication.
+func (s *SOCKS5Server) checkProxyAuth(req *http.Request) bool {
+	cfg := s.transport.Config
+	if cfg.ProxyUser == "" && cfg.ProxyPass == "" {
+		return true
+	}
+	encoded, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.ProxyUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.ProxyPass)) == 1
+	return userOK && passOK
+}
+
+// writeHTTPError maps a failed dial to the closest HTTP status.
+func writeHTTPError(conn net.Conn, err error) error {
+	status := http.StatusBadGateway
+	var dialErr *DialError
+	if errors.As(err, &dialErr) {
+		switch dialErr.Code {
+		case DialTimeout:
+			status = http.StatusGatewayTimeout
+		case DialBlocked:
+			status = http.StatusForbidden
+		}
+	}
+	_, writeErr := fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+	return writeErr
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+)
+
+// Instance is a running client: the address pool, the transport, the local
+// DNS server when configured and the SOCKS5/HTTP proxy, all built from one
+// configuration.
+type Instance struct {
+	Config    *config.Config
+	Pool      *AddressPool
+	Transport *Transport
+	DNS       *DNSServer // nil unless local_dns.listen is set
+	SOCKS     *SOCKS5Server
+	StartedAt time.Time
+}
+
+// StartInstance builds the client for cfg and starts its listeners.
+// Nothing is left running when it fails.
+func StartInstance(cfg *config.Config) (*Instance, error) {
+	tlsDialer, err := NewTLSDialer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS: %w", err)
+	}
+	httpVersion, err := HTTPVersion(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	shape, err := tunnel.NewShape(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	pool, err := NewAddressPool(cfg.Addresses, cfg.Port, cfg.Host, tlsDialer, httpVersion, shape)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create address pool: %w", err)
+	}
+	inst := &Instance{
+		Config:    cfg,
+		Pool:      pool,
+		Transport: NewTransport(cfg, pool),
+	}
+
+	if cfg.LocalDNS.Listen != "" {
+		dnsServer, err := NewDNSServer(inst.Transport)
+		if err == nil {
+			err = dnsServer.Start()
+		}
+		if err != nil {
+			_ = inst.Stop(context.Background())
+			return nil, fmt.Errorf("failed to start DNS server: %w", err)
+		}
+		inst.DNS = dnsServer
+	}
+
+	inst.SOCKS = NewSOCKS5Server(cfg.ProxyPort, inst.Transport)
+	if err := inst.SOCKS.Start(); err != nil {
+		inst.SOCKS = nil
+		_ = inst.Stop(context.Background())
+		return nil, fmt.Errorf("failed to start SOCKS5 server: %w", err)
+	}
+	inst.StartedAt = time.Now()
+	return inst, nil
+}
+
+// Stop closes the listeners and the connections they accepted, waiting
+// for the proxy until ctx is done, and then stops the pool and transport.
+func (i *Instance) Stop(ctx context.Context) error {
+	var errs []error
+	if i.SOCKS != nil {
+		errs = append(errs, i.SOCKS.Stop(ctx))
+	}
+	if i.DNS != nil {
+		errs = append(errs, i.DNS.Stop())
+	}
+	i.Transport.Close()
+	i.Pool.Stop()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/metrics"
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+)
+
+// clientMetrics are the counters the transport and proxy update as they
+// serve.
+type clientMetrics struct {
+	registry *metrics.Registry
+
+	connectionsActive *metrics.Gauge
+	connections       *metrics.CounterVec
+	connectDuration   *metrics.HistogramVec
+	sessionsCreated   *metrics.Counter
+	responses         *metrics.CounterVec
+}
+
+func newClientMetrics(t *Transport) *clientMetrics {
+	r := metrics.NewRegistry()
+	m := &clientMetrics{
+		registry: r,
+		connectionsActive: r.Gauge("fsak_client_connections_active",
+			"Open local proxy connections.").With(),
+		connections: r.Counter("fsak_client_connections_total",
+			"Local proxy connections, by route and dial result.", "route", "result"),
+		connectDuration: r.Histogram("fsak_client_connect_duration_seconds",
+			"Time until a proxy connection's dial outcome is known, by route.", metrics.DurationBuckets, "route"),
+		sessionsCreated: r.Counter("fsak_client_sessions_created_total",
+			"Tunnel sessions opened to the server.").With(),
+		responses: r.Counter("fsak_client_http_responses_total",
+			"Server responses to tunnel requests, by request kind and status code (\"error\" when none arrived).", "kind", "code"),
+	}
+	r.Collect("fsak_client_bytes_total", "Tunnel payload bytes, by direction.", "counter", []string{"direction"},
+		func(emit func(float64, ...string)) {
+			stats := t.Stats()
+			emit(float64(stats.Up), "up")
+			emit(float64(stats.Down), "down")
+		})
+	r.Collect("fsak_client_padding_bytes_total", "Padding bytes sent and received, by direction.", "counter", []string{"direction"},
+		func(emit func(float64, ...string)) {
+			stats := t.Stats()
+			emit(float64(stats.PaddingUp), "up")
+			emit(float64(stats.PaddingDown), "down")
+		})
+	r.Collect("fsak_client_pool_quality", "Quality score of each probed server address.", "gauge", []string{"address"},
+		func(emit func(float64, ...string)) {
+			for _, s := range t.Pool.snapshot() {
+				emit(s.Quality, s.IP)
+			}
+		})
+	r.Collect("fsak_client_pool_latency_seconds", "Smoothed latency of each probed server address, by stage.", "gauge", []string{"address", "stage"},
+		func(emit func(float64, ...string)) {
+			for _, s := range t.Pool.snapshot() {
+				emit(s.TCPLatency.Seconds(), s.IP, "tcp")
+				emit(s.AppLatency.Seconds(), s.IP, "app")
+			}
+		})
+	r.Collect("fsak_client_pool_healthy", "Whether each probed server address is usable (1) or not (0).", "gauge", []string{"address"},
+		func(emit func(float64, ...string)) {
+			for _, s := range t.Pool.snapshot() {
+				healthy := 0.0
+				if s.Healthy {
+					healthy = 1
+				}
+				emit(healthy, s.IP)
+			}
+		})
+	r.Collect("fsak_client_pool_failures", "Recent failures of each probed server address.", "gauge", []string{"address"},
+		func(emit func(float64, ...string)) {
+			for _, s := range t.Pool.snapshot() {
+				emit(float64(s.Fails), s.IP)
+			}
+		})
+	return m
+}
+
+// Metrics serves the client's metrics in the Prometheus text format on
+// /metrics.
+func (t *Transport) Metrics() http.Handler {
+	return t.metrics.registry.Handler()
+}
+
+// observeResponse counts the outcome of one tunnel request.
+func (m *clientMetrics) observeResponse(kind tunnel.RequestKind, resp *http.Response, err error) {
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	m.responses.With(kind.String(), code).Inc()
+}
+
+// trackConnect wraps a proxy connection's confirm callback so the first
+// outcome it reports is counted and timed.
+func (m *clientMetrics) trackConnect(route string, confirm func(error) error) func(error) error {
+	start := time.Now()
+	var once sync.Once
+	return func(err error) error {
+		once.Do(func() {
+			result := "ok"
+			var dialErr *DialError
+			switch {
+			case errors.As(err, &dialErr):
+				result = dialErr.Code
+			case err != nil:
+				result = "error"
+			}
+			m.connections.With(route, result).Inc()
+			m.connectDuration.With(route).Observe(time.Since(start).Seconds())
+		})
+		return confirm(err)
+	}
+}
+
+// snapshot copies the stats of every address that has been probed or used,
+// ordered by address.
+func (p *AddressPool) snapshot() []IPStats {
+	p.mu.RLock()
+	out := make([]IPStats, 0, len(p.candidates))
+	for _, s := range p.candidates {
+		if !s.LastCheck.IsZero() || !s.LastRuntime.IsZero() {
+			out = append(out, *s)
+		}
+	}
+	p.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
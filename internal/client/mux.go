@@ -0,0 +1,544 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+)
+
+const (
+	defaultMuxSessions = 2
+	// muxIdleTimeout is how long a session with no streams keeps polling
+	// before it is closed.
+	muxIdleTimeout = 30 * time.Second
+)
+
+var errMuxClosed = errors.New("mux session closed")
+
+// muxPool spreads streams over a few long-lived tunnel sessions instead of
+// opening a session, and its own polling loops, per connection.
+type muxPool struct {
+	t    *Transport
+	size int
+
+	mu       sync.Mutex
+	sessions []*muxSession
+}
+
+func newMuxPool(t *Transport, size int) *muxPool {
+	if size <= 0 {
+		size = defaultMuxSessions
+	}
+	return &muxPool{t: t, size: size}
+}
+
+// session returns a ready session, creating one while the pool is below
+// its size and otherwise picking the least loaded.
+func (p *muxPool) session() (*muxSession, error) {
+	p.mu.Lock()
+	alive := p.sessions[:0]
+	for _, ms := range p.sessions {
+		if !ms.isClosed() {
+			alive = append(alive, ms)
+		}
+	}
+	p.sessions = alive
+
+	var ms *muxSession
+	if len(p.sessions) < p.size {
+		ms = newMuxSession(p.t)
+		p.sessions = append(p.sessions, ms)
+		p.mu.Unlock()
+		go ms.start()
+	} else {
+		for _, candidate := range p.sessions {
+			if ms == nil || candidate.load() < ms.load() {
+				ms = candidate
+			}
+		}
+		p.mu.Unlock()
+	}
+
+	<-ms.ready
+	if ms.err != nil {
+		return nil, ms.err
+	}
+	return ms, nil
+}
+
+// close stops every session of the pool.
+func (p *muxPool) close() {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = nil
+	p.mu.Unlock()
+	for _, ms := range sessions {
+		ms.stop()
+	}
+}
+
+// Relay opens a stream to target on a shared session and pumps clientConn
+// through it. confirm receives the server's dial outcome, or nil right away
+// in optimistic mode.
+func (p *muxPool) Relay(target string, clientConn net.Conn, optimistic bool, confirm func(error) error) error {
+	var ms *muxSession
+	var st *clientStream
+	var replyErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		var err error
+		if ms, err = p.session(); err == nil {
+			st, err = ms.open(target)
+		}
+		if err != nil {
+			_ = confirm(err)
+			return err
+		}
+		if optimistic {
+			break
+		}
+		replyErr = st.waitReply(p.t.Client.Timeout)
+		// A session that dies before the server answers never dialed,
+		// typically because the server restarted: try a fresh one.
+		if !errors.Is(replyErr, errMuxClosed) {
+			break
+		}
+		ms.remove(st.id)
+	}
+	defer ms.remove(st.id)
+
+	var err error
+	if optimistic {
+		err = confirm(nil)
+	} else {
+		err = replyErr
+		if confirmErr := confirm(err); err == nil {
+			err = confirmErr
+		}
+	}
+	if err != nil {
+		st.close()
+		return err
+	}
+	p.t.withAccessLog(ms.sess.log.With("stream", st.id), RouteProxy, target, clientConn, st.relay)
+	return nil
+}
+
+// muxSession is one tunnel session carrying many streams. Outgoing frames
+// are batched into upload chunks by sendLoop; downloads are demultiplexed
+// by Write.
+type muxSession struct {
+	t    *Transport
+	sess *tunnelSession
+
+	ready chan struct{}
+	err   error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+
+	mu        sync.Mutex
+	streams   map[uint32]*clientStream
+	nextID    uint32
+	out       []byte
+	notify    chan struct{}
+	idleSince time.Time
+	closed    bool
+}
+
+func newMuxSession(t *Transport) *muxSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &muxSession{
+		t:         t,
+		ready:     make(chan struct{}),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		streams:   make(map[uint32]*clientStream),
+		notify:    make(chan struct{}, 1),
+		idleSince: time.Now(),
+	}
+}
+
+func (ms *muxSession) start() {
+	sess, err := ms.t.newTunnelSession()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(ms.ctx, ms.t.Client.Timeout)
+		err = ms.t.sendConnect(ctx, sess, uploadFlagFirst|uploadFlagMux, "")
+		cancel()
+	}
+	if err != nil {
+		ms.err = err
+		close(ms.ready)
+		ms.stop()
+		return
+	}
+	ms.sess = sess
+	close(ms.ready)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		ms.sendLoop()
+	}()
+	go func() {
+		defer wg.Done()
+		ms.t.downloadLoop(ms.ctx, sess, ms, ms.done, ms.stop)
+	}()
+	go func() {
+		defer wg.Done()
+		ms.idleLoop()
+	}()
+	wg.Wait()
+}
+
+func (ms *muxSession) stop() {
+	ms.once.Do(func() {
+		ms.mu.Lock()
+		ms.closed = true
+		streams := ms.streams
+		ms.streams = nil
+		ms.mu.Unlock()
+
+		close(ms.done)
+		ms.cancel()
+		for _, st := range streams {
+			st.fail(errMuxClosed)
+		}
+	})
+}
+
+func (ms *muxSession) isClosed() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.closed
+}
+
+func (ms *muxSession) load() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.streams)
+}
+
+func (ms *muxSession) open(target string) (*clientStream, error) {
+	if len(target) > tunnel.MuxMaxData {
+		return nil, fmt.Errorf("target address too long")
+	}
+	ms.mu.Lock()
+	if ms.closed {
+		ms.mu.Unlock()
+		return nil, errMuxClosed
+	}
+	ms.nextID++
+	st := newClientStream(ms, ms.nextID)
+	ms.streams[st.id] = st
+	ms.mu.Unlock()
+
+	ms.queue(func(b []byte) []byte {
+		return tunnel.AppendMuxFrame(b, tunnel.MuxOpen, st.id, []byte(target))
+	})
+	return st, nil
+}
+
+func (ms *muxSession) remove(id uint32) {
+	ms.mu.Lock()
+	if ms.streams != nil {
+		delete(ms.streams, id)
+		if len(ms.streams) == 0 {
+			ms.idleSince = time.Now()
+		}
+	}
+	ms.mu.Unlock()
+}
+
+func (ms *muxSession) queue(appendFrames func([]byte) []byte) {
+	ms.mu.Lock()
+	if ms.closed {
+		ms.mu.Unlock()
+		return
+	}
+	ms.out = appendFrames(ms.out)
+	ms.mu.Unlock()
+	select {
+	case ms.notify <- struct{}{}:
+	default:
+	}
+}
+
+// sendLoop turns queued frames into upload chunks. Chunks are pipelined
+// and the server restores their order by sequence number.
+func (ms *muxSession) sendLoop() {
+	seq := uint32(1)
+	var sendWG sync.WaitGroup
+	sem := make(chan struct{}, uploadPipelineLimit)
+	defer sendWG.Wait()
+
+	for {
+		select {
+		case <-ms.notify:
+		case <-ms.done:
+			return
+		}
+
+		for {
+			ms.mu.Lock()
+			n := tunnel.MuxPrefix(ms.out, maxUploadChunkSize)
+			if n == 0 {
+				ms.mu.Unlock()
+				break
+			}
+			body, backing, err := ms.t.buildUploadChunk(ms.sess.upAEAD, seq, 0, nil, ms.out[:n])
+			ms.out = append(ms.out[:0], ms.out[n:]...)
+			ms.mu.Unlock()
+			if err != nil {
+				ms.sess.log.Warn("upload failed", "err", err)
+				ms.stop()
+				return
+			}
+			seq++
+
+			select {
+			case sem <- struct{}{}:
+			case <-ms.done:
+				ms.t.putFrameBuffer(backing)
+				return
+			}
+			sendWG.Add(1)
+			go func(payload, backing []byte) {
+				defer sendWG.Done()
+				defer func() {
+					<-sem
+					ms.t.putFrameBuffer(backing)
+				}()
+				dur, sendErr := ms.t.sendChunk(ms.ctx, ms.sess, payload)
+				ms.t.Pool.ReportRuntimeResult(ms.sess.serverIP, sendErr == nil, dur)
+				if sendErr != nil && ms.ctx.Err() == nil {
+					ms.sess.log.Warn("upload failed", "err", sendErr)
+					ms.stop()
+				}
+			}(body, backing)
+		}
+	}
+}
+
+func (ms *muxSession) idleLoop() {
+	ticker := time.NewTicker(muxIdleTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ms.done:
+			return
+		case <-ticker.C:
+			ms.mu.Lock()
+			idle := len(ms.streams) == 0 && time.Since(ms.idleSince) > muxIdleTimeout
+			ms.mu.Unlock()
+			if idle {
+				ms.stop()
+				return
+			}
+		}
+	}
+}
+
+// Write demultiplexes the frames of one download payload.
+func (ms *muxSession) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		typ, id, data, rest, err := tunnel.NextMuxFrame(p)
+		if err != nil {
+			return 0, err
+		}
+		p = rest
+
+		ms.mu.Lock()
+		st := ms.streams[id]
+		ms.mu.Unlock()
+		if st == nil {
+			continue
+		}
+		switch typ {
+		case tunnel.MuxReply:
+			st.reply(data)
+		case tunnel.MuxData:
+			st.deliver(append([]byte(nil), data...))
+		case tunnel.MuxClose:
+			st.deliver(nil)
+		case tunnel.MuxWindow:
+			if inc, err := tunnel.MuxWindowIncrement(data); err == nil {
+				st.grant(inc)
+			}
+		}
+	}
+	return n, nil
+}
+
+// clientStream is one proxied connection inside a mux session.
+type clientStream struct {
+	ms *muxSession
+	id uint32
+
+	replyCh   chan error
+	replyOnce sync.Once
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	recvQ  [][]byte // a nil entry marks MuxClose from the server
+	window int
+	err    error
+	closed bool
+}
+
+func newClientStream(ms *muxSession, id uint32) *clientStream {
+	st := &clientStream{
+		ms:      ms,
+		id:      id,
+		replyCh: make(chan error, 1),
+		window:  tunnel.MuxInitialWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *clientStream) reply(code []byte) {
+	var err error
+	if len(code) > 0 {
+		err = &DialError{Code: string(code)}
+	}
+	st.replyOnce.Do(func() { st.replyCh <- err })
+	if err != nil {
+		st.fail(err)
+	}
+}
+
+func (st *clientStream) waitReply(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-st.replyCh:
+		return err
+	case <-timer.C:
+		return &DialError{Code: DialTimeout}
+	}
+}
+
+func (st *clientStream) deliver(data []byte) {
+	st.mu.Lock()
+	if !st.closed {
+		st.recvQ = append(st.recvQ, data)
+	}
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *clientStream) grant(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+// fail ends the stream without further frames, e.g. when its session dies
+// or the server could not dial.
+func (st *clientStream) fail(err error) {
+	st.replyOnce.Do(func() { st.replyCh <- err })
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.closed = true
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+// close tells the server the stream is finished.
+func (st *clientStream) close() {
+	st.mu.Lock()
+	wasClosed := st.closed
+	st.closed = true
+	st.mu.Unlock()
+	st.cond.Broadcast()
+	if !wasClosed {
+		st.ms.queue(func(b []byte) []byte {
+			return tunnel.AppendMuxFrame(b, tunnel.MuxClose, st.id, nil)
+		})
+	}
+}
+
+// relay pumps clientConn through the stream until either side closes.
+func (st *clientStream) relay(clientConn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		st.downPump(clientConn)
+		// Unblock the upload pump once the server side is gone.
+		_ = clientConn.Close()
+	}()
+	st.upPump(clientConn)
+	st.close()
+	wg.Wait()
+}
+
+func (st *clientStream) upPump(clientConn net.Conn) {
+	buf := make([]byte, tunnel.MuxMaxData)
+	for {
+		st.mu.Lock()
+		for st.window <= 0 && !st.closed {
+			st.cond.Wait()
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return
+		}
+		limit := min(st.window, len(buf))
+		st.mu.Unlock()
+
+		n, err := clientConn.Read(buf[:limit])
+		if n > 0 {
+			st.mu.Lock()
+			st.window -= n
+			st.mu.Unlock()
+			data := buf[:n]
+			st.ms.queue(func(b []byte) []byte {
+				return tunnel.AppendMuxFrame(b, tunnel.MuxData, st.id, data)
+			})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (st *clientStream) downPump(clientConn net.Conn) {
+	for {
+		st.mu.Lock()
+		for len(st.recvQ) == 0 && !st.closed {
+			st.cond.Wait()
+		}
+		if len(st.recvQ) == 0 {
+			st.mu.Unlock()
+			return
+		}
+		data := st.recvQ[0]
+		st.recvQ = st.recvQ[1:]
+		st.mu.Unlock()
+
+		if data == nil {
+			return
+		}
+		if _, err := clientConn.Write(data); err != nil {
+			return
+		}
+		n := len(data)
+		st.ms.queue(func(b []byte) []byte {
+			return tunnel.AppendMuxWindow(b, st.id, n)
+		})
+	}
+}
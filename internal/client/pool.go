@@ -2,15 +2,19 @@ package client
 
 import (
 	"bufio"
-	"crypto/tls"
+	"context"
 	"fmt"
+	"log/slog"
 	"math"
 	"math/rand"
 	"net"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/paulGUZU/fsak/pkg/tunnel"
 )
 
 type IPStats struct {
@@ -30,23 +34,34 @@ type AddressPool struct {
 	configAddrs []string
 	targetPort  int
 	targetHost  string
-	targetTLS   bool
+	tlsDialer   *TLSDialer
+	httpVersion string
+	shape       *tunnel.Shape
 
 	candidates map[string]*IPStats
 	sortedIPs  []string
+	degraded   bool // no address passed the last check
+	logger     *slog.Logger
 
 	mu       sync.RWMutex
 	stopCh   chan struct{}
 	stopOnce sync.Once
 }
 
-func NewAddressPool(addrs []string, port int, host string, tlsEnabled bool) (*AddressPool, error) {
+// NewAddressPool creates a pool probing addrs on port. tlsDialer is nil for
+// plaintext servers; otherwise the probe handshakes exactly like the tunnel
+// transport does. httpVersion, as returned by HTTPVersion, selects the
+// protocol the probe speaks, and shape what its request looks like.
+func NewAddressPool(addrs []string, port int, host string, tlsDialer *TLSDialer, httpVersion string, shape *tunnel.Shape) (*AddressPool, error) {
 	pool := &AddressPool{
 		configAddrs: addrs,
 		targetPort:  port,
 		targetHost:  strings.TrimSpace(host),
-		targetTLS:   tlsEnabled,
+		tlsDialer:   tlsDialer,
+		httpVersion: httpVersion,
+		shape:       shape,
 		candidates:  make(map[string]*IPStats),
+		logger:      slog.Default(),
 		stopCh:      make(chan struct{}),
 	}
 
@@ -121,7 +136,7 @@ func (p *AddressPool) checkLoop() {
 				sem <- struct{}{}
 				defer func() { <-sem }()
 
-				tcpLatency, appLatency, ok := probeEndpointQuality(target, p.targetPort, p.targetHost, p.targetTLS)
+				tcpLatency, appLatency, ok := p.probe(target)
 				q := qualityScore(tcpLatency, appLatency, ok, 0)
 				results <- result{
 					IP:      target,
@@ -177,15 +192,15 @@ func (p *AddressPool) checkLoop() {
 
 		if len(active) > 0 {
 			best := p.candidates[active[0]]
-			fmt.Printf("\r\033[K[%s] Active IPs: %d | Best: %s (tcp=%v app=%v)",
-				time.Now().Format("15:04:05"),
-				len(active),
-				best.IP,
-				best.TCPLatency,
-				best.AppLatency,
-			)
-		} else {
-			fmt.Printf("\r\033[K[%s] Warning: No quality-healthy IPs available.", time.Now().Format("15:04:05"))
+			if p.degraded {
+				p.logger.Info("server addresses reachable again", "active", len(active))
+			}
+			p.degraded = false
+			p.logger.Debug("address pool checked", "active", len(active), "best", best.IP,
+				"tcp", best.TCPLatency, "app", best.AppLatency)
+		} else if !p.degraded {
+			p.degraded = true
+			p.logger.Warn("no healthy server addresses", "candidates", len(p.candidates))
 		}
 		p.mu.Unlock()
 
@@ -211,7 +226,31 @@ func qualityScore(tcpLatency, appLatency time.Duration, ok bool, fails int) floa
 	return base
 }
 
-func probeEndpointQuality(ip string, port int, host string, tlsEnabled bool) (tcpLatency, appLatency time.Duration, ok bool) {
+// probe measures ip with the protocol the tunnel uses. For HTTP/3 the
+// connection latency is the QUIC handshake.
+func (p *AddressPool) probe(ip string) (tcpLatency, appLatency time.Duration, ok bool) {
+	switch p.httpVersion {
+	case "2":
+		return probeEndpointHTTP2(ip, p.targetPort, p.targetHost, p.tlsDialer, p.shape)
+	case "3":
+		return probeEndpointHTTP3(ip, p.targetPort, p.targetHost, p.tlsDialer, p.shape)
+	default:
+		return probeEndpointQuality(ip, p.targetPort, p.targetHost, p.tlsDialer, p.shape)
+	}
+}
+
+// probeRequest is a download request for a throwaway session, shaped like
+// tunnel traffic so the probe does not stand out.
+func probeRequest(ctx context.Context, shape *tunnel.Shape, baseURL, ip, host string) *http.Request {
+	req, _ := shape.NewRequest(ctx, tunnel.RequestDownload, baseURL, newSessionID(), newSessionID(), nil)
+	req.Host = strings.TrimSpace(host)
+	if req.Host == "" {
+		req.Host = ip
+	}
+	return req
+}
+
+func probeEndpointQuality(ip string, port int, host string, tlsDialer *TLSDialer, shape *tunnel.Shape) (tcpLatency, appLatency time.Duration, ok bool) {
 	timeout := 2 * time.Second
 	address := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
 
@@ -224,15 +263,8 @@ func probeEndpointQuality(ip string, port int, host string, tlsEnabled bool) (tc
 	defer conn.Close()
 
 	probeConn := conn
-	if tlsEnabled {
-		serverName := strings.TrimSpace(host)
-		if serverName == "" {
-			serverName = ip
-		}
-		tlsConn := tls.Client(conn, &tls.Config{
-			ServerName:         serverName,
-			InsecureSkipVerify: serverName == ip,
-		})
+	if tlsDialer != nil {
+		tlsConn := tlsDialer.Client(conn, ip)
 		_ = tlsConn.SetDeadline(time.Now().Add(timeout))
 		if err := tlsConn.Handshake(); err != nil {
 			return tcpLatency, 0, false
@@ -240,14 +272,11 @@ func probeEndpointQuality(ip string, port int, host string, tlsEnabled bool) (tc
 		probeConn = tlsConn
 	}
 
-	reqHost := strings.TrimSpace(host)
-	if reqHost == "" {
-		reqHost = ip
-	}
+	req := probeRequest(context.Background(), shape, "http://"+address, ip, host)
+	req.Close = true
 	_ = probeConn.SetDeadline(time.Now().Add(timeout))
 	startApp := time.Now()
-	_, err = fmt.Fprintf(probeConn, "HEAD /download?session_id=quality HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", reqHost)
-	if err != nil {
+	if err := req.Write(probeConn); err != nil {
 		return tcpLatency, 0, false
 	}
 
@@ -264,6 +293,55 @@ func probeEndpointQuality(ip string, port int, host string, tlsEnabled bool) (tc
 	return tcpLatency, appLatency, true
 }
 
+// probeEndpointHTTP2 is probeEndpointQuality over HTTP/2: h2 negotiated
+// through ALPN with TLS, prior-knowledge h2c without.
+func probeEndpointHTTP2(ip string, port int, host string, tlsDialer *TLSDialer, shape *tunnel.Shape) (tcpLatency, appLatency time.Duration, ok bool) {
+	timeout := 2 * time.Second
+	address := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return 0, 0, false
+	}
+	tcpLatency = time.Since(start)
+	defer conn.Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	defer transport.CloseIdleConnections()
+	scheme := "http"
+	if tlsDialer != nil {
+		tlsConn := tlsDialer.Client(conn, ip)
+		_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return tcpLatency, 0, false
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+			return tcpLatency, 0, false
+		}
+		scheme = "https"
+		transport.Protocols.SetHTTP2(true)
+		transport.DialTLSContext = func(context.Context, string, string) (net.Conn, error) { return tlsConn, nil }
+	} else {
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		transport.DialContext = func(context.Context, string, string) (net.Conn, error) { return conn, nil }
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req := probeRequest(ctx, shape, scheme+"://"+address, ip, host)
+
+	startApp := time.Now()
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return tcpLatency, 0, false
+	}
+	resp.Body.Close()
+
+	appLatency = time.Since(startApp)
+	return tcpLatency, appLatency, true
+}
+
 func (p *AddressPool) Stop() {
 	p.stopOnce.Do(func() {
 		close(p.stopCh)
@@ -293,6 +371,21 @@ func (p *AddressPool) PickBest() string {
 	return p.sortedIPs[rand.Intn(topN)]
 }
 
+// Best returns the stats of the highest ranked address of the last check,
+// or false when none passed it.
+func (p *AddressPool) Best() (IPStats, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.sortedIPs) == 0 {
+		return IPStats{}, false
+	}
+	stats, ok := p.candidates[p.sortedIPs[0]]
+	if !ok {
+		return IPStats{}, false
+	}
+	return *stats, true
+}
+
 func (p *AddressPool) ReportRuntimeResult(ip string, success bool, latency time.Duration) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -0,0 +1,395 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+)
+
+// Routing actions.
+const (
+	RouteProxy  = "proxy"
+	RouteDirect = "direct"
+	RouteReject = "reject"
+)
+
+const routeResolveTimeout = 2 * time.Second
+
+// Router picks the action for a destination from the routing rules. A nil
+// Router sends everything through the tunnel.
+type Router struct {
+	rules   []routeRule
+	def     string
+	resolve bool
+	lookup  func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+type routeRule struct {
+	action   string
+	domains  []string
+	keywords []string
+	regexes  []*regexp.Regexp
+	nets     []netip.Prefix
+	ports    []portRange
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+// NewRouter compiles the routing section of the config, loading the GeoIP
+// and geosite files that the rules refer to. lookup resolves domain
+// destinations for IP conditions when resolve is on.
+func NewRouter(cfg config.Routing, lookup func(ctx context.Context, host string) ([]netip.Addr, error)) (*Router, error) {
+	r := &Router{
+		def:     strings.ToLower(strings.TrimSpace(cfg.Default)),
+		resolve: cfg.Resolve,
+		lookup:  lookup,
+	}
+	if r.def == "" {
+		r.def = RouteProxy
+	}
+	if !validAction(r.def) {
+		return nil, fmt.Errorf("unknown routing default %q", cfg.Default)
+	}
+
+	var geoIP, geosite map[string][]string
+	for i, rc := range cfg.Rules {
+		rule := routeRule{action: strings.ToLower(strings.TrimSpace(rc.Action))}
+		if !validAction(rule.action) {
+			return nil, fmt.Errorf("routing rule %d: unknown action %q", i+1, rc.Action)
+		}
+		for _, d := range rc.Domain {
+			rule.domains = append(rule.domains, normalizeDomain(d))
+		}
+		for _, k := range rc.Keyword {
+			rule.keywords = append(rule.keywords, strings.ToLower(k))
+		}
+		for _, expr := range rc.Regex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %d: %w", i+1, err)
+			}
+			rule.regexes = append(rule.regexes, re)
+		}
+		for _, c := range rc.CIDR {
+			prefix, err := parsePrefix(c)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %d: %w", i+1, err)
+			}
+			rule.nets = append(rule.nets, prefix)
+		}
+		if len(rc.GeoIP) > 0 {
+			if geoIP == nil {
+				var err error
+				if geoIP, err = loadGeoFile(cfg.GeoIPFile, "geoip_file"); err != nil {
+					return nil, err
+				}
+			}
+			for _, code := range rc.GeoIP {
+				entries, ok := geoIP[strings.ToLower(code)]
+				if !ok {
+					return nil, fmt.Errorf("routing rule %d: geoip %q not in %s", i+1, code, cfg.GeoIPFile)
+				}
+				for _, c := range entries {
+					prefix, err := parsePrefix(c)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", cfg.GeoIPFile, err)
+					}
+					rule.nets = append(rule.nets, prefix)
+				}
+			}
+		}
+		if len(rc.Geosite) > 0 {
+			if geosite == nil {
+				var err error
+				if geosite, err = loadGeoFile(cfg.GeositeFile, "geosite_file"); err != nil {
+					return nil, err
+				}
+			}
+			for _, code := range rc.Geosite {
+				entries, ok := geosite[strings.ToLower(code)]
+				if !ok {
+					return nil, fmt.Errorf("routing rule %d: geosite %q not in %s", i+1, code, cfg.GeositeFile)
+				}
+				for _, d := range entries {
+					rule.domains = append(rule.domains, normalizeDomain(d))
+				}
+			}
+		}
+		for _, spec := range rc.Ports {
+			pr, err := parsePortRange(spec)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %d: %w", i+1, err)
+			}
+			rule.ports = append(rule.ports, pr)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func validAction(action string) bool {
+	return action == RouteProxy || action == RouteDirect || action == RouteReject
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parsePortRange(spec string) (portRange, error) {
+	lo, hi, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+	if !isRange {
+		hi = lo
+	}
+	from, err1 := strconv.ParseUint(lo, 10, 16)
+	to, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || from == 0 || from > to {
+		return portRange{}, fmt.Errorf("invalid port %q", spec)
+	}
+	return portRange{uint16(from), uint16(to)}, nil
+}
+
+// loadGeoFile reads "code value" lines, separated by spaces, tabs or a
+// comma, into values by lowercase code. Blank lines and # comments are
+// skipped.
+func loadGeoFile(path, field string) (map[string][]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("routing rules use %s, which is not set", field)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"code value\"", path, n)
+		}
+		code := strings.ToLower(fields[0])
+		entries[code] = append(entries[code], fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Route returns the action for target ("host:port").
+func (r *Router) Route(target string) string {
+	if r == nil {
+		return RouteProxy
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return r.def
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+
+	var addrs []netip.Addr
+	var domain string
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr.Unmap()}
+	} else {
+		domain = normalizeDomain(host)
+	}
+	resolved := domain == ""
+
+	for _, rule := range r.rules {
+		if len(rule.ports) > 0 && !rule.matchPort(uint16(port)) {
+			continue
+		}
+		if !rule.hasConditions() {
+			return rule.action
+		}
+		if domain != "" && rule.matchDomain(domain) {
+			return rule.action
+		}
+		if len(rule.nets) == 0 {
+			continue
+		}
+		if !resolved && r.resolve {
+			addrs = r.lookupAddrs(domain)
+			resolved = true
+		}
+		for _, addr := range addrs {
+			if rule.matchAddr(addr) {
+				return rule.action
+			}
+		}
+	}
+	return r.def
+}
+
+func (r *Router) lookupAddrs(host string) []netip.Addr {
+	ctx, cancel := context.WithTimeout(context.Background(), routeResolveTimeout)
+	defer cancel()
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil
+	}
+	out := make([]netip.Addr, len(addrs))
+	for i, addr := range addrs {
+		out[i] = addr.Unmap()
+	}
+	return out
+}
+
+func (rule *routeRule) hasConditions() bool {
+	return len(rule.domains) > 0 || len(rule.keywords) > 0 || len(rule.regexes) > 0 || len(rule.nets) > 0
+}
+
+func (rule *routeRule) matchPort(port uint16) bool {
+	for _, pr := range rule.ports {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *routeRule) matchDomain(domain string) bool {
+	for _, d := range rule.domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	for _, k := range rule.keywords {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+	for _, re := range rule.regexes {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *routeRule) matchAddr(addr netip.Addr) bool {
+	for _, n := range rule.nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Direct connects to target without the tunnel, bound to the outbound
+// interface when one is set, and relays clientConn to it. confirm gets
+// the dial outcome as a *DialError like a tunneled Connect.
+func (t *Transport) Direct(target string, clientConn net.Conn, confirm func(error) error) error {
+	conn, err := t.dialDirect(target)
+	if err != nil {
+		dialErr := &DialError{Code: localDialCode(err)}
+		_ = confirm(dialErr)
+		return dialErr
+	}
+	defer conn.Close()
+	if err := confirm(nil); err != nil {
+		return err
+	}
+	t.withAccessLog(t.logger, RouteDirect, target, clientConn, func(clientConn net.Conn) {
+		relayDirect(conn, clientConn)
+	})
+	return nil
+}
+
+func relayDirect(conn, clientConn net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(conn, clientConn)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+		close(done)
+	}()
+	_, _ = io.Copy(clientConn, conn)
+	_ = clientConn.Close()
+	<-done
+}
+
+// dialDirect dials target locally. While the local DNS server runs, host
+// names are resolved through it so the system resolver, which may point
+// back at it, never hands out a fake address.
+func (t *Transport) dialDirect(target string) (net.Conn, error) {
+	dialer := newDialer(t.outboundInterface)
+	d := t.dns.Load()
+	host, port, err := net.SplitHostPort(target)
+	if d == nil || err != nil {
+		return dialer.Dial("tcp", target)
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.Dial("tcp", target)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout)
+	defer cancel()
+	addrs, err := d.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// localDialCode classifies a local dial failure with the codes the server
+// reports for tunneled ones.
+func localDialCode(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return DialNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return DialHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return DialTimeout
+	default:
+		return "failed"
+	}
+}
@@ -1,41 +1,130 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // SOCKS5 Constants
 const (
 	verSocks5  = 0x05
+	verAuth    = 0x01 // RFC 1929 sub-negotiation
 	cmdConnect = 0x01
+	cmdUDP     = 0x03
 	atypIPv4   = 0x01
 	atypDomain = 0x03
 	atypIPv6   = 0x04
 )
 
+// Authentication methods
+const (
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// SOCKS5 reply codes
+const (
+	repSucceeded          = 0x00
+	repGeneralFailure     = 0x01
+	repNotAllowed         = 0x02
+	repNetworkUnreachable = 0x03
+	repHostUnreachable    = 0x04
+	repConnectionRefused  = 0x05
+	repTTLExpired         = 0x06
+	repCommandUnsupported = 0x07
+)
+
 type SOCKS5Server struct {
 	addr      string
 	transport *Transport
+	allow     []*net.IPNet
+	router    *Router
+	logger    *slog.Logger
 	mu        sync.Mutex
 	listener  net.Listener
 	conns     map[net.Conn]struct{}
+	tunnels   map[uint64]*proxyTunnel
+	lastID    uint64
 	done      chan struct{}
 	serveErr  chan error
 	wg        sync.WaitGroup
 }
 
+// NewSOCKS5Server creates a proxy listening on port at the configured
+// proxy_bind address, which defaults to loopback so the tunnel is not
+// shared with the local network by accident.
 func NewSOCKS5Server(port int, t *Transport) *SOCKS5Server {
+	bind := strings.TrimSpace(t.Config.ProxyBind)
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
 	return &SOCKS5Server{
-		addr:      fmt.Sprintf(":%d", port),
+		addr:      net.JoinHostPort(bind, strconv.Itoa(port)),
 		transport: t,
+		logger:    t.logger,
 		conns:     make(map[net.Conn]struct{}),
+		tunnels:   make(map[uint64]*proxyTunnel),
+	}
+}
+
+func parseAllowlist(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy_allow entry %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_allow entry %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allowed reports whether a client may use the proxy. An empty allowlist
+// admits everyone who can reach the listener.
+func (s *SOCKS5Server) allowed(addr net.Addr) bool {
+	if len(s.allow) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range s.allow {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
 	}
+	return false
 }
 
 func (s *SOCKS5Server) Start() error {
@@ -46,6 +135,17 @@ func (s *SOCKS5Server) Start() error {
 		return fmt.Errorf("SOCKS5 server already running")
 	}
 
+	allow, err := parseAllowlist(s.transport.Config.ProxyAllow)
+	if err != nil {
+		return err
+	}
+	s.allow = allow
+	router, err := NewRouter(s.transport.Config.Routing, s.transport.lookupHost)
+	if err != nil {
+		return err
+	}
+	s.router = router
+
 	l, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
@@ -54,7 +154,7 @@ func (s *SOCKS5Server) Start() error {
 	s.done = make(chan struct{})
 	s.serveErr = make(chan error, 1)
 
-	log.Printf("SOCKS5 Proxy listening on %s", s.addr)
+	s.logger.Info("SOCKS5/HTTP proxy listening", "addr", s.addr)
 	go s.acceptLoop(l, s.done, s.serveErr)
 	return nil
 }
@@ -138,7 +238,7 @@ func (s *SOCKS5Server) acceptLoop(l net.Listener, done chan struct{}, errCh chan
 				return
 			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.Printf("Accept temporary failure: %v", err)
+				s.logger.Warn("accept failed", "err", err)
 				continue
 			}
 			select {
@@ -147,6 +247,11 @@ func (s *SOCKS5Server) acceptLoop(l net.Listener, done chan struct{}, errCh chan
 			}
 			return
 		}
+		if !s.allowed(conn.RemoteAddr()) {
+			s.logger.Warn("client rejected: not in proxy_allow", "client", conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
 		if !s.trackConn(conn) {
 			_ = conn.Close()
 			continue
@@ -175,10 +280,92 @@ func (s *SOCKS5Server) untrackConn(conn net.Conn) {
 	s.mu.Unlock()
 }
 
+// proxyTunnel is a proxied TCP connection while it relays.
+type proxyTunnel struct {
+	id      uint64
+	route   string
+	target  string
+	started time.Time
+	conn    *countingConn
+}
+
+func (s *SOCKS5Server) openTunnel(conn net.Conn, route, target string) *proxyTunnel {
+	tun := &proxyTunnel{route: route, target: target, started: time.Now(), conn: &countingConn{Conn: conn}}
+	s.mu.Lock()
+	s.lastID++
+	tun.id = s.lastID
+	s.tunnels[tun.id] = tun
+	s.mu.Unlock()
+	return tun
+}
+
+func (s *SOCKS5Server) closeTunnel(tun *proxyTunnel) {
+	s.mu.Lock()
+	delete(s.tunnels, tun.id)
+	s.mu.Unlock()
+}
+
+// tunnelInfo is a proxied connection as the control API lists it. Up is
+// what the local client sent.
+type tunnelInfo struct {
+	ID         uint64  `json:"id"`
+	Client     string  `json:"client"`
+	Route      string  `json:"route"`
+	Target     string  `json:"target"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Up         int64   `json:"up"`
+	Down       int64   `json:"down"`
+}
+
+// tunnelInfos lists the open TCP connections, oldest first.
+func (s *SOCKS5Server) tunnelInfos(now time.Time) []tunnelInfo {
+	s.mu.Lock()
+	infos := make([]tunnelInfo, 0, len(s.tunnels))
+	for _, tun := range s.tunnels {
+		infos = append(infos, tunnelInfo{
+			ID:         tun.id,
+			Client:     tun.conn.RemoteAddr().String(),
+			Route:      tun.route,
+			Target:     tun.target,
+			AgeSeconds: now.Sub(tun.started).Seconds(),
+			Up:         tun.conn.read.Load(),
+			Down:       tun.conn.written.Load(),
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// closeTunnelID closes the client side of an open connection, which ends
+// its relay.
+func (s *SOCKS5Server) closeTunnelID(id uint64) bool {
+	s.mu.Lock()
+	tun, ok := s.tunnels[id]
+	s.mu.Unlock()
+	if ok {
+		_ = tun.conn.Close()
+	}
+	return ok
+}
+
 func (s *SOCKS5Server) handleConnection(conn net.Conn) {
 	defer s.untrackConn(conn)
 	defer conn.Close()
 
+	// HTTP proxy clients share the port; anything that does not start with
+	// the SOCKS5 version byte is treated as an HTTP request.
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] != verSocks5 {
+		s.handleHTTP(conn, br)
+		return
+	}
+	conn = &bufferedConn{Conn: conn, r: br}
+
 	// 1. Negotiation
 	// Client sends: [VER, NMETHODS, METHODS...]
 	header := make([]byte, 2)
@@ -194,9 +381,8 @@ func (s *SOCKS5Server) handleConnection(conn net.Conn) {
 		return
 	}
 
-	// We only support NO AUTH (0x00)
 	// Server responds: [VER, METHOD]
-	if _, err := conn.Write([]byte{verSocks5, 0x00}); err != nil {
+	if !s.negotiateAuth(conn, methods) {
 		return
 	}
 
@@ -207,76 +393,251 @@ func (s *SOCKS5Server) handleConnection(conn net.Conn) {
 		return
 	}
 	// buf[1] is CMD
-	if buf[1] != cmdConnect {
-		// Reply Command Not Supported
-		// ...
+	if buf[1] != cmdConnect && buf[1] != cmdUDP {
+		_ = writeReply(conn, repCommandUnsupported)
+		return
+	}
+
+	target, err := readSOCKSAddr(io.MultiReader(bytes.NewReader(buf[3:4]), conn))
+	if err != nil {
+		return
+	}
+
+	if buf[1] == cmdUDP {
+		// The requested address is only a hint about where the client will
+		// send from; the association accepts any port on the client's IP.
+		s.handleUDPAssociate(conn)
+		return
+	}
+
+	// 3. Connect to Remote, via the HTTP tunnel unless routed otherwise
+	s.connect(target, conn, func(dialErr error) error {
+		return writeReply(conn, replyCode(dialErr))
+	})
+}
+
+// connect sends target where the routing rules say and relays conn to it.
+// confirm reports the dial outcome to the client. In optimistic mode
+// success is reported before the server has dialed, which saves a round
+// trip but turns every failure into a closed connection. Otherwise the
+// reply waits for the server's dial outcome.
+func (s *SOCKS5Server) connect(target string, conn net.Conn, confirm func(error) error) {
+	m := s.transport.metrics
+	m.connectionsActive.Inc()
+	defer m.connectionsActive.Dec()
+
+	route := RouteProxy
+	target, err := s.transport.realTarget(target)
+	if err == nil {
+		route = s.router.Route(target)
+	}
+	confirm = m.trackConnect(route, confirm)
+	if err != nil {
+		_ = confirm(&DialError{Code: DialHostUnreachable})
+		return
+	}
+	if route == RouteReject {
+		_ = confirm(&DialError{Code: DialBlocked})
+		return
+	}
+
+	tun := s.openTunnel(conn, route, target)
+	defer s.closeTunnel(tun)
+	conn = tun.conn
+
+	if route == RouteDirect {
+		if err := s.transport.Direct(target, conn, confirm); err != nil {
+			s.logger.Info("connect failed", "client", conn.RemoteAddr().String(), "route", route, "target", target, "err", err)
+		}
 		return
 	}
 
-	var targetAddr string
-	switch buf[3] {
+	if s.transport.Config.SOCKSOptimistic {
+		if err := confirm(nil); err != nil {
+			return
+		}
+		if err := s.transport.Tunnel(target, conn); err != nil {
+			s.logger.Warn("tunnel failed", "client", conn.RemoteAddr().String(), "target", target, "err", err)
+		}
+		return
+	}
+	if err := s.transport.Connect(target, conn, confirm); err != nil {
+		s.logger.Info("connect failed", "client", conn.RemoteAddr().String(), "route", route, "target", target, "err", err)
+	}
+}
+
+// negotiateAuth picks the authentication method and, when credentials are
+// configured, runs the RFC 1929 username/password exchange.
+func (s *SOCKS5Server) negotiateAuth(conn net.Conn, methods []byte) bool {
+	cfg := s.transport.Config
+	if cfg.ProxyUser == "" && cfg.ProxyPass == "" {
+		_, err := conn.Write([]byte{verSocks5, methodNoAuth})
+		return err == nil
+	}
+	if !bytes.Contains(methods, []byte{methodUserPass}) {
+		_, _ = conn.Write([]byte{verSocks5, methodNoAcceptable})
+		return false
+	}
+	if _, err := conn.Write([]byte{verSocks5, methodUserPass}); err != nil {
+		return false
+	}
+
+	// Client sends: [VER, ULEN, UNAME, PLEN, PASSWD]
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != verAuth {
+		return false
+	}
+	user := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return false
+	}
+	pass := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return false
+	}
+
+	userOK := subtle.ConstantTimeCompare(user, []byte(cfg.ProxyUser)) == 1
+	passOK := subtle.ConstantTimeCompare(pass, []byte(cfg.ProxyPass)) == 1
+	if !userOK || !passOK {
+		s.logger.Warn("SOCKS5 authentication failed", "client", conn.RemoteAddr().String())
+		_, _ = conn.Write([]byte{verAuth, 0x01})
+		return false
+	}
+	_, err := conn.Write([]byte{verAuth, 0x00})
+	return err == nil
+}
+
+func (s *SOCKS5Server) handleUDPAssociate(conn net.Conn) {
+	assoc, err := newUDPAssociation(conn)
+	if err != nil {
+		s.logger.Warn("UDP associate failed", "client", conn.RemoteAddr().String(), "err", err)
+		_ = writeReply(conn, repGeneralFailure)
+		return
+	}
+	defer assoc.Close()
+
+	err = s.transport.Associate(assoc, conn, func(openErr error) error {
+		if openErr != nil {
+			return writeReply(conn, replyCode(openErr))
+		}
+		return writeReplyAddr(conn, repSucceeded, assoc.LocalAddr().String())
+	})
+	if err != nil {
+		s.logger.Warn("UDP associate failed", "client", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// readSOCKSAddr reads [ATYP, ADDR, PORT] and returns it as "host:port".
+func readSOCKSAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
 	case atypIPv4:
 		ip := make([]byte, 4)
-		if _, err := io.ReadFull(conn, ip); err != nil {
-			return
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
 		}
-		targetAddr = net.IP(ip).String()
+		host = net.IP(ip).String()
 	case atypDomain:
 		lenBuf := make([]byte, 1)
-		if _, err := io.ReadFull(conn, lenBuf); err != nil {
-			return
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return "", err
 		}
-		l := int(lenBuf[0])
-		domain := make([]byte, l)
-		if _, err := io.ReadFull(conn, domain); err != nil {
-			return
+		domain := make([]byte, int(lenBuf[0]))
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
 		}
-		targetAddr = string(domain)
+		host = string(domain)
 	case atypIPv6:
 		ip := make([]byte, 16)
-		if _, err := io.ReadFull(conn, ip); err != nil {
-			return
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
 		}
-		targetAddr = fmt.Sprintf("[%s]", net.IP(ip).String())
+		host = net.IP(ip).String()
 	default:
-		return
+		return "", fmt.Errorf("unknown address type %d", atyp[0])
 	}
 
 	portBuf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, portBuf); err != nil {
-		return
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return "", err
 	}
 	port := binary.BigEndian.Uint16(portBuf)
-	target := fmt.Sprintf("%s:%d", targetAddr, port)
-
-	// 3. Connect to Remote via HTTP Tunnel
-	// log.Printf("Connecting to %s", target)
-
-	// Delegate to Transport
-	// Transport needs to return an error or nil.
-	// We need to send SOCKS reply *before* piping data?
-	// Standard SOCKS5:
-	// - Client sends Request
-	// - Server attempts connection
-	// - Server sends Reply (Success/Fail)
-	// - Then transfer begins.
-
-	// BUT, our Transport establishes the tunnel asynchronously?
-	// Actually, the server side dials the target.
-	// If server side fails to dial, it writes nothing and closes?
-	// OR we assume success and start streaming?
-	// If server fails, the stream closes.
-
-	// Let's send Success reply immediately then start tunnel.
-	// This makes "connection refused" handling harder (user sees connection closed instead of SOCKS error),
-	// but is faster/simpler for this tunnel Architecture.
-
-	// Send Reply: Success
-	// [VER, REP(0x00), RSV, ATYP, BND.ADDR, BND.PORT]
-	// We just verify success.
-	conn.Write([]byte{verSocks5, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
-
-	if err := s.transport.Tunnel(target, conn); err != nil {
-		log.Printf("Tunnel error: %v", err)
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// appendSOCKSAddr appends "host:port" to dst as [ATYP, ADDR, PORT].
+func appendSOCKSAddr(dst []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return dst, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return dst, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(dst, atypIPv4)
+			dst = append(dst, ip4...)
+		} else {
+			dst = append(dst, atypIPv6)
+			dst = append(dst, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return dst, errors.New("domain name too long")
+		}
+		dst = append(dst, atypDomain, byte(len(host)))
+		dst = append(dst, host...)
+	}
+	return binary.BigEndian.AppendUint16(dst, uint16(port)), nil
+}
+
+// writeReply sends [VER, REP, RSV, ATYP, BND.ADDR, BND.PORT] with an
+// unspecified IPv4 bind address.
+func writeReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{verSocks5, rep, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// writeReplyAddr sends a reply carrying bindAddr as BND.ADDR and BND.PORT.
+func writeReplyAddr(conn net.Conn, rep byte, bindAddr string) error {
+	reply, err := appendSOCKSAddr([]byte{verSocks5, rep, 0x00}, bindAddr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(reply)
+	return err
+}
+
+func replyCode(err error) byte {
+	if err == nil {
+		return repSucceeded
+	}
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) {
+		return repGeneralFailure
+	}
+	switch dialErr.Code {
+	case DialRefused:
+		return repConnectionRefused
+	case DialHostUnreachable:
+		return repHostUnreachable
+	case DialNetworkUnreachable:
+		return repNetworkUnreachable
+	case DialTimeout:
+		return repTTLExpired
+	case DialBlocked:
+		return repNotAllowed
+	default:
+		return repGeneralFailure
 	}
 }
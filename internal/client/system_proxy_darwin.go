@@ -10,15 +10,34 @@ import (
 	"strings"
 )
 
-type socksProxyState struct {
+type proxyState struct {
 	enabled bool
 	server  string
 	port    int
 }
 
+// proxyKind names the networksetup verbs for one proxy protocol. The local
+// listener speaks SOCKS5 and HTTP on the same port, so all kinds are set.
+type proxyKind struct {
+	get      string
+	set      string
+	setState string
+}
+
+var proxyKinds = []proxyKind{
+	{get: "-getsocksfirewallproxy", set: "-setsocksfirewallproxy", setState: "-setsocksfirewallproxystate"},
+	{get: "-getwebproxy", set: "-setwebproxy", setState: "-setwebproxystate"},
+	{get: "-getsecurewebproxy", set: "-setsecurewebproxy", setState: "-setsecurewebproxystate"},
+}
+
+type serviceProxyKey struct {
+	service string
+	kind    proxyKind
+}
+
 type darwinSystemProxySession struct {
 	services []string
-	previous map[string]socksProxyState
+	previous map[serviceProxyKey]proxyState
 }
 
 func EnableSystemProxy(port int) (SystemProxySession, error) {
@@ -30,33 +49,35 @@ func EnableSystemProxy(port int) (SystemProxySession, error) {
 		return nil, fmt.Errorf("no active macOS network services found")
 	}
 
-	previous := make(map[string]socksProxyState, len(services))
+	previous := make(map[serviceProxyKey]proxyState, len(services)*len(proxyKinds))
 	changed := make([]string, 0, len(services))
 
 	for _, service := range services {
-		state, err := getSOCKSProxyState(service)
-		if err != nil {
-			rollbackErr := rollbackServices(changed, previous)
-			if rollbackErr != nil {
-				return nil, fmt.Errorf("failed on service %q: %v (rollback failed: %v)", service, err, rollbackErr)
+		for _, kind := range proxyKinds {
+			state, err := getProxyState(service, kind)
+			if err != nil {
+				rollbackErr := rollbackServices(append(changed, service), previous)
+				if rollbackErr != nil {
+					return nil, fmt.Errorf("failed on service %q: %v (rollback failed: %v)", service, err, rollbackErr)
+				}
+				return nil, fmt.Errorf("failed reading proxy state for %q: %w", service, err)
 			}
-			return nil, fmt.Errorf("failed reading proxy state for %q: %w", service, err)
-		}
-		previous[service] = state
-
-		if err := runNetworkSetup("-setsocksfirewallproxy", service, "127.0.0.1", strconv.Itoa(port)); err != nil {
-			rollbackErr := rollbackServices(changed, previous)
-			if rollbackErr != nil {
-				return nil, fmt.Errorf("failed enabling SOCKS for %q: %v (rollback failed: %v)", service, err, rollbackErr)
+			previous[serviceProxyKey{service, kind}] = state
+
+			if err := runNetworkSetup(kind.set, service, "127.0.0.1", strconv.Itoa(port)); err != nil {
+				rollbackErr := rollbackServices(append(changed, service), previous)
+				if rollbackErr != nil {
+					return nil, fmt.Errorf("failed enabling proxy for %q: %v (rollback failed: %v)", service, err, rollbackErr)
+				}
+				return nil, fmt.Errorf("failed enabling proxy for %q: %w", service, err)
 			}
-			return nil, fmt.Errorf("failed enabling SOCKS for %q: %w", service, err)
-		}
-		if err := runNetworkSetup("-setsocksfirewallproxystate", service, "on"); err != nil {
-			rollbackErr := rollbackServices(changed, previous)
-			if rollbackErr != nil {
-				return nil, fmt.Errorf("failed enabling SOCKS state for %q: %v (rollback failed: %v)", service, err, rollbackErr)
+			if err := runNetworkSetup(kind.setState, service, "on"); err != nil {
+				rollbackErr := rollbackServices(append(changed, service), previous)
+				if rollbackErr != nil {
+					return nil, fmt.Errorf("failed enabling proxy state for %q: %v (rollback failed: %v)", service, err, rollbackErr)
+				}
+				return nil, fmt.Errorf("failed enabling proxy state for %q: %w", service, err)
 			}
-			return nil, fmt.Errorf("failed enabling SOCKS state for %q: %w", service, err)
 		}
 		changed = append(changed, service)
 	}
@@ -71,37 +92,39 @@ func (s *darwinSystemProxySession) Disable() error {
 	return rollbackServices(s.services, s.previous)
 }
 
-func rollbackServices(services []string, previous map[string]socksProxyState) error {
+func rollbackServices(services []string, previous map[serviceProxyKey]proxyState) error {
 	var errs []string
 	for _, service := range services {
-		state, ok := previous[service]
-		if !ok {
-			continue
-		}
-		if state.enabled {
-			port := state.port
-			if port <= 0 {
-				port = 1080
-			}
-			server := state.server
-			if strings.TrimSpace(server) == "" {
-				server = "127.0.0.1"
+		for _, kind := range proxyKinds {
+			state, ok := previous[serviceProxyKey{service, kind}]
+			if !ok {
+				continue
 			}
-			if err := runNetworkSetup("-setsocksfirewallproxy", service, server, strconv.Itoa(port)); err != nil {
-				errs = append(errs, fmt.Sprintf("%s: %v", service, err))
+			if state.enabled {
+				port := state.port
+				if port <= 0 {
+					port = 1080
+				}
+				server := state.server
+				if strings.TrimSpace(server) == "" {
+					server = "127.0.0.1"
+				}
+				if err := runNetworkSetup(kind.set, service, server, strconv.Itoa(port)); err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %v", service, err))
+					continue
+				}
+				if err := runNetworkSetup(kind.setState, service, "on"); err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %v", service, err))
+				}
 				continue
 			}
-			if err := runNetworkSetup("-setsocksfirewallproxystate", service, "on"); err != nil {
+			if err := runNetworkSetup(kind.setState, service, "off"); err != nil {
 				errs = append(errs, fmt.Sprintf("%s: %v", service, err))
 			}
-			continue
-		}
-		if err := runNetworkSetup("-setsocksfirewallproxystate", service, "off"); err != nil {
-			errs = append(errs, fmt.Sprintf("%s: %v", service, err))
 		}
 	}
 	if len(errs) > 0 {
-		return fmt.Errorf("failed to restore macOS SOCKS proxy on services: %s", strings.Join(errs, "; "))
+		return fmt.Errorf("failed to restore macOS proxy on services: %s", strings.Join(errs, "; "))
 	}
 	return nil
 }
@@ -127,13 +150,13 @@ func listNetworkServices() ([]string, error) {
 	return services, nil
 }
 
-func getSOCKSProxyState(service string) (socksProxyState, error) {
-	out, err := runNetworkSetupOutput("-getsocksfirewallproxy", service)
+func getProxyState(service string, kind proxyKind) (proxyState, error) {
+	out, err := runNetworkSetupOutput(kind.get, service)
 	if err != nil {
-		return socksProxyState{}, err
+		return proxyState{}, err
 	}
 
-	state := socksProxyState{}
+	state := proxyState{}
 	for _, line := range strings.Split(out, "\n") {
 		parts := strings.SplitN(line, ":", 2)
 		if len(parts) != 2 {
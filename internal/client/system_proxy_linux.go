@@ -17,7 +17,8 @@ type linuxSystemProxySession struct {
 	mode     string            // "gnome" or "kde"
 }
 
-// EnableSystemProxy enables SOCKS proxy on Linux
+// EnableSystemProxy points the SOCKS, HTTP and HTTPS proxies at the local
+// listener on Linux
 func EnableSystemProxy(port int) (SystemProxySession, error) {
 	// Try GNOME/gsettings first, then KDE
 	if isGNOMEDesktop() {
@@ -64,6 +65,8 @@ func enableGNOMEProxy(port int) (SystemProxySession, error) {
 	settings := []string{
 		"org.gnome.system.proxy",
 		"org.gnome.system.proxy.socks",
+		"org.gnome.system.proxy.http",
+		"org.gnome.system.proxy.https",
 	}
 	
 	for _, schema := range settings {
@@ -76,14 +79,18 @@ func enableGNOMEProxy(port int) (SystemProxySession, error) {
 		}
 	}
 
-	// Enable SOCKS proxy
-	if err := setGSetting("org.gnome.system.proxy.socks", "host", "127.0.0.1"); err != nil {
-		session.Disable()
-		return nil, fmt.Errorf("failed to set SOCKS host: %w", err)
-	}
-	if err := setGSetting("org.gnome.system.proxy.socks", "port", fmt.Sprintf("%d", port)); err != nil {
-		session.Disable()
-		return nil, fmt.Errorf("failed to set SOCKS port: %w", err)
+	// Point SOCKS, HTTP and HTTPS at the local listener, which speaks all
+	// three on one port
+	for _, kind := range []string{"socks", "http", "https"} {
+		schema := "org.gnome.system.proxy." + kind
+		if err := setGSetting(schema, "host", "127.0.0.1"); err != nil {
+			session.Disable()
+			return nil, fmt.Errorf("failed to set %s proxy host: %w", kind, err)
+		}
+		if err := setGSetting(schema, "port", fmt.Sprintf("%d", port)); err != nil {
+			session.Disable()
+			return nil, fmt.Errorf("failed to set %s proxy port: %w", kind, err)
+		}
 	}
 	if err := setGSetting("org.gnome.system.proxy", "mode", "manual"); err != nil {
 		session.Disable()
@@ -120,6 +127,12 @@ func enableKDEProxy(port int) (SystemProxySession, error) {
 		session.Disable()
 		return nil, fmt.Errorf("failed to set SOCKS proxy: %w", err)
 	}
+	for _, key := range []string{"httpProxy", "httpsProxy"} {
+		if err := setKSetting(configCmd, key, fmt.Sprintf("http://127.0.0.1 %d", port)); err != nil {
+			session.Disable()
+			return nil, fmt.Errorf("failed to set %s: %w", key, err)
+		}
+	}
 	if err := setKSetting(configCmd, "Proxy/Mode", "1"); err != nil {
 		session.Disable()
 		return nil, fmt.Errorf("failed to enable proxy mode: %w", err)
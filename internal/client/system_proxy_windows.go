@@ -27,7 +27,8 @@ type windowsSystemProxySession struct {
 	previousOverride  string
 }
 
-// EnableSystemProxy enables SOCKS proxy on Windows
+// EnableSystemProxy points the SOCKS, HTTP and HTTPS proxies at the local
+// listener on Windows
 func EnableSystemProxy(port int) (SystemProxySession, error) {
 	session := &windowsSystemProxySession{}
 
@@ -49,8 +50,9 @@ func EnableSystemProxy(port int) (SystemProxySession, error) {
 		session.previousOverride = val
 	}
 
-	// Set SOCKS proxy (format: socks=host:port)
-	proxyServer := fmt.Sprintf("socks=127.0.0.1:%d", port)
+	// The local listener speaks both SOCKS5 and HTTP, so every scheme
+	// points at the same port (format: scheme=host:port;...)
+	proxyServer := fmt.Sprintf("http=127.0.0.1:%[1]d;https=127.0.0.1:%[1]d;socks=127.0.0.1:%[1]d", port)
 	
 	if err := key.SetDWordValue(proxyEnableKey, 1); err != nil {
 		return nil, fmt.Errorf("failed to enable proxy: %w", err)
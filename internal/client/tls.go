@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/crypto"
+)
+
+// TLSDialer performs the TLS handshake for both the HTTP transport and the
+// address pool probe, so the two present the same ClientHello and apply the
+// same verification rules.
+type TLSDialer struct {
+	config *tls.Config
+}
+
+// HTTPVersion normalizes the profile's http_version to "1.1", "2" or "3".
+func HTTPVersion(cfg *config.Config) (string, error) {
+	switch v := strings.TrimSpace(cfg.HTTPVersion); v {
+	case "", "1.1", "1":
+		return "1.1", nil
+	case "2", "h2", "h2c":
+		return "2", nil
+	case "3", "h3":
+		if !cfg.TLS {
+			return "", errors.New("http_version 3 requires tls")
+		}
+		return "3", nil
+	default:
+		return "", fmt.Errorf("unknown http_version %q", cfg.HTTPVersion)
+	}
+}
+
+// alpnProtocols is what the ClientHello offers for an HTTP version.
+func alpnProtocols(version string) []string {
+	switch version {
+	case "2":
+		return []string{"h2", "http/1.1"}
+	case "3":
+		return []string{"h3"}
+	default:
+		return []string{"http/1.1"}
+	}
+}
+
+// NewTLSDialer builds the client TLS configuration from the profile. It
+// returns nil when TLS is disabled.
+//
+// With pinned SPKI hashes and no CA bundle, the pin replaces chain
+// verification, which is what self-signed servers need: the server's own
+// certificate must carry a pinned key. With a CA bundle the chain is
+// verified against it and pins, if any, must match a certificate of the
+// verified chain.
+func NewTLSDialer(cfg *config.Config) (*TLSDialer, error) {
+	version, err := HTTPVersion(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	serverName := strings.TrimSpace(cfg.SNI)
+	if serverName == "" {
+		serverName = strings.TrimSpace(cfg.Host)
+	}
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: alpnProtocols(version),
+	}
+
+	if caFile := strings.TrimSpace(cfg.CAFile); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if len(cfg.PinSHA256) > 0 {
+		pins := make(map[string]struct{}, len(cfg.PinSHA256))
+		for _, pin := range cfg.PinSHA256 {
+			pins[strings.TrimSpace(pin)] = struct{}{}
+		}
+		if tlsConfig.RootCAs == nil {
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyLeafPin(rawCerts, pins, time.Now())
+			}
+		} else {
+			tlsConfig.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+				return verifyChainPins(chains, pins)
+			}
+		}
+	}
+
+	return &TLSDialer{config: tlsConfig}, nil
+}
+
+var errPinMismatch = errors.New("server certificate does not match any pinned key")
+
+// verifyLeafPin checks the server's own certificate, the one whose key the
+// handshake proves, when nothing else is verified. Other certificates the
+// server sends are not trusted, so pinning them would let anyone append
+// them behind their own certificate.
+func verifyLeafPin(rawCerts [][]byte, pins map[string]struct{}, now time.Time) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := pins[crypto.SPKIHash(leaf)]; !ok {
+		return errPinMismatch
+	}
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return errors.New("server certificate is expired or not yet valid")
+	}
+	return nil
+}
+
+// verifyChainPins checks the chains verified against the CA bundle, where
+// an intermediate or root key may be pinned as well.
+func verifyChainPins(chains [][]*x509.Certificate, pins map[string]struct{}) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if _, ok := pins[crypto.SPKIHash(cert)]; ok {
+				return nil
+			}
+		}
+	}
+	return errPinMismatch
+}
+
+// Client wraps conn in a TLS client. ip is used as the server name when the
+// profile sets neither sni nor host. protos overrides the ALPN list derived
+// from http_version.
+func (d *TLSDialer) Client(conn net.Conn, ip string, protos ...string) *tls.Conn {
+	cfg := d.config.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = ip
+	}
+	if len(protos) > 0 {
+		cfg.NextProtos = protos
+	}
+	return tls.Client(conn, cfg)
+}
+
+// QUICConfig returns the TLS configuration for an HTTP/3 connection to ip.
+func (d *TLSDialer) QUICConfig(ip string) *tls.Config {
+	cfg := d.config.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = ip
+	}
+	cfg.NextProtos = alpnProtocols("3")
+	cfg.MinVersion = tls.VersionTLS13
+	return cfg
+}
+
+// DialContext returns a DialTLSContext function for http.Transport.
+func (d *TLSDialer) DialContext(dialer *net.Dialer, protos ...string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := d.Client(conn, host, protos...)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
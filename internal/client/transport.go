@@ -3,32 +3,51 @@ package client
 import (
 	"bytes"
 	"context"
-	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/paulGUZU/fsak/pkg/config"
 	"github.com/paulGUZU/fsak/pkg/crypto"
+	"github.com/paulGUZU/fsak/pkg/tunnel"
 )
 
 const (
 	uploadFlagFirst     byte = 1
+	uploadFlagUDP       byte = 2 // session relays datagrams instead of a stream
+	uploadFlagMux       byte = 4 // session carries multiplexed streams
+	uploadFlagPadded    byte = 8 // frames carry [padLen(2)] and filler
 	uploadFrameHeader        = 5 // [seq(4)][flags(1)]
 	uploadPipelineLimit      = 4
+	downloadFrameHeader      = 4 // [seq(4)]
+
+	// frameSlack covers the version byte, nonce and tag of a sealed frame.
+	frameSlack = 64
 
 	minUploadChunkSize     = 16 * 1024
 	initialUploadChunkSize = 64 * 1024
 	maxUploadChunkSize     = 512 * 1024
 
 	downloadNoDataBackoff = 120 * time.Millisecond
+
+	// streamBufferedThreshold is how late the headers of a streaming
+	// download may arrive before the path is assumed to buffer responses.
+	streamBufferedThreshold = 10 * time.Second
+	// maxDownloadFrame bounds one streamed record; the server never seals
+	// more than 256 KB of data per frame.
+	maxDownloadFrame = 1 << 20
 )
 
 type Transport struct {
@@ -39,37 +58,149 @@ type Transport struct {
 	outboundInterface string
 	secretKey         [32]byte
 	framePool         sync.Pool
+	mux               *muxPool // nil when every connection gets its own session
+	pollDownloads     atomic.Bool
+	stats             trafficCounters
+	dns               atomic.Pointer[DNSServer] // set while a local DNS server runs
+	metrics           *clientMetrics
+	logger            *slog.Logger
+}
+
+// TrafficStats counts tunnel payload bytes and the padding sent and
+// received on top of them.
+type TrafficStats struct {
+	Up          int64
+	Down        int64
+	PaddingUp   int64
+	PaddingDown int64
+}
+
+type trafficCounters struct {
+	up, down, padUp, padDown atomic.Int64
+}
+
+// Stats returns the traffic counters since the transport was created.
+func (t *Transport) Stats() TrafficStats {
+	return TrafficStats{
+		Up:          t.stats.up.Load(),
+		Down:        t.stats.down.Load(),
+		PaddingUp:   t.stats.padUp.Load(),
+		PaddingDown: t.stats.padDown.Load(),
+	}
+}
+
+// countingConn counts the bytes read from and written to a proxy
+// connection for the access log and the control API.
+type countingConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// withAccessLog runs relay on clientConn and, when the access log is on,
+// records what the connection carried once it returns. Up is what the
+// local client sent.
+func (t *Transport) withAccessLog(log *slog.Logger, route, target string, clientConn net.Conn, relay func(net.Conn)) {
+	if !t.Config.Log.Access {
+		relay(clientConn)
+		return
+	}
+	start := time.Now()
+	cc, ok := clientConn.(*countingConn)
+	if !ok {
+		cc = &countingConn{Conn: clientConn}
+	}
+	relay(cc)
+	log.Info("access",
+		"client", clientConn.RemoteAddr().String(),
+		"route", route,
+		"target", target,
+		"up", cc.read.Load(),
+		"down", cc.written.Load(),
+		"duration", time.Since(start).Round(time.Millisecond),
+	)
 }
 
 func NewTransport(cfg *config.Config, pool *AddressPool) *Transport {
-	httpTransport := newHTTPTransport("")
-	return &Transport{
+	httpTransport := newHTTPTransport("", pool.tlsDialer, pool.httpVersion)
+	t := &Transport{
 		Config:    cfg,
 		Pool:      pool,
 		Client:    &http.Client{Timeout: 30 * time.Second, Transport: httpTransport},
 		secretKey: crypto.DeriveKey(cfg.Secret),
+		logger:    slog.Default(),
 		framePool: sync.Pool{
 			New: func() any {
-				return make([]byte, aes.BlockSize+maxUploadChunkSize+uploadFrameHeader+256)
+				return make([]byte, frameSlack+maxUploadChunkSize+uploadFrameHeader+256)
 			},
 		},
 	}
+	if cfg.Mux {
+		t.mux = newMuxPool(t, cfg.MuxSessions)
+	}
+	t.metrics = newClientMetrics(t)
+	return t
 }
 
-func newHTTPTransport(outboundInterface string) *http.Transport {
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+// Close stops the shared mux sessions and drops idle server connections.
+// Relays still running on the transport fail.
+func (t *Transport) Close() {
+	if t.mux != nil {
+		t.mux.close()
 	}
-	if control := interfaceDialerControl(strings.TrimSpace(outboundInterface)); control != nil {
-		dialer.Control = control
+	t.Client.CloseIdleConnections()
+}
+
+// newHTTPTransport builds the round tripper for httpVersion. HTTP/2 runs
+// every concurrent request of the client over one connection per server
+// address; without TLS that is h2c with prior knowledge.
+func newHTTPTransport(outboundInterface string, tlsDialer *TLSDialer, httpVersion string) http.RoundTripper {
+	if httpVersion == "3" {
+		return newHTTP3Transport(outboundInterface, tlsDialer)
 	}
-	return &http.Transport{
+
+	dialer := newDialer(outboundInterface)
+	transport := &http.Transport{
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 100,
 		DisableKeepAlives:   false,
 		DialContext:         dialer.DialContext,
 	}
+	if tlsDialer != nil {
+		transport.DialTLSContext = tlsDialer.DialContext(dialer)
+	}
+	if httpVersion == "2" {
+		transport.Protocols = new(http.Protocols)
+		if tlsDialer != nil {
+			transport.Protocols.SetHTTP1(true)
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+	return transport
+}
+
+func newDialer(outboundInterface string) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if control := interfaceDialerControl(strings.TrimSpace(outboundInterface)); control != nil {
+		dialer.Control = control
+	}
+	return dialer
 }
 
 func (t *Transport) SetOutboundInterface(name string) {
@@ -78,16 +209,151 @@ func (t *Transport) SetOutboundInterface(name string) {
 		return
 	}
 	t.outboundInterface = name
-	t.Client.Transport = newHTTPTransport(name)
+	old := t.Client.Transport
+	t.Client.Transport = newHTTPTransport(name, t.Pool.tlsDialer, t.Pool.httpVersion)
+	if closer, ok := old.(io.Closer); ok {
+		_ = closer.Close()
+	}
 }
 
-func (t *Transport) Tunnel(target string, clientConn net.Conn) error {
+// tunnelSession carries the per-session state shared by the upload and
+// download loops.
+type tunnelSession struct {
+	id       string
+	auth     string
+	baseURL  string
+	host     string
+	serverIP string
+	upAEAD   cipher.AEAD
+	downAEAD cipher.AEAD
+	ws       *wsConn      // nil unless the session runs over a WebSocket
+	log      *slog.Logger // carries the session id
+}
+
+func (t *Transport) newTunnelSession() (*tunnelSession, error) {
 	serverIP := t.Pool.PickBest()
 	sessionID := newSessionID()
 
-	destURL := fmt.Sprintf("%s://%s:%d", t.scheme(), serverIP, t.Config.Port)
-	hostHeader := t.Config.Host
+	auth, err := crypto.NewAuthToken(t.secretKey, t.Config.User, sessionID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	upAEAD, err := crypto.NewSessionAEAD(t.secretKey, sessionID, crypto.LabelUpload)
+	if err != nil {
+		return nil, err
+	}
+	downAEAD, err := crypto.NewSessionAEAD(t.secretKey, sessionID, crypto.LabelDownload)
+	if err != nil {
+		return nil, err
+	}
+	sess := &tunnelSession{
+		id:       sessionID,
+		auth:     auth,
+		baseURL:  fmt.Sprintf("%s://%s:%d", t.scheme(), serverIP, t.Config.Port),
+		host:     t.Config.Host,
+		serverIP: serverIP,
+		upAEAD:   upAEAD,
+		downAEAD: downAEAD,
+		log:      t.logger.With("session", sessionID),
+	}
+	if t.useWebSocket() {
+		ctx, cancel := context.WithTimeout(context.Background(), t.Client.Timeout)
+		sess.ws, err = t.dialWebSocket(ctx, sess)
+		cancel()
+		if err != nil {
+			sess.log.Warn("websocket dial failed", "server", serverIP, "err", err)
+			t.Pool.ReportRuntimeResult(serverIP, false, 0)
+			return nil, err
+		}
+	}
+	t.metrics.sessionsCreated.Inc()
+	sess.log.Debug("session opened", "server", serverIP)
+	return sess, nil
+}
+
+// newRequest builds a kind request for the session as the profile shapes
+// it.
+func (s *tunnelSession) newRequest(ctx context.Context, shape *tunnel.Shape, kind tunnel.RequestKind, body io.Reader) *http.Request {
+	req, _ := shape.NewRequest(ctx, kind, s.baseURL, s.id, s.auth, body)
+	req.Host = s.host
+	return req
+}
+
+// Tunnel relays clientConn to target optimistically: the target address
+// travels with the first chunk of client data and a failed dial only shows
+// up as the tunnel closing. With mux enabled the connection becomes a
+// stream on a shared session.
+func (t *Transport) Tunnel(target string, clientConn net.Conn) error {
+	if t.mux != nil {
+		return t.mux.Relay(target, clientConn, true, func(error) error { return nil })
+	}
+	sess, err := t.newTunnelSession()
+	if err != nil {
+		return err
+	}
+	t.withAccessLog(sess.log, RouteProxy, target, clientConn, func(conn net.Conn) {
+		t.relay(sess, target, 0, conn)
+	})
+	return nil
+}
+
+// Connect asks the server to dial target before any client data is read and
+// hands the outcome to confirm, which typically writes the SOCKS reply. The
+// relay only starts when both the dial and confirm succeed. A failed dial is
+// reported as a *DialError.
+func (t *Transport) Connect(target string, clientConn net.Conn, confirm func(error) error) error {
+	if t.mux != nil {
+		return t.mux.Relay(target, clientConn, false, confirm)
+	}
+	sess, err := t.newTunnelSession()
+	if err != nil {
+		_ = confirm(err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Client.Timeout)
+	err = t.sendConnect(ctx, sess, uploadFlagFirst, target)
+	cancel()
+	if confirmErr := confirm(err); err == nil {
+		err = confirmErr
+	}
+	if err != nil {
+		return err
+	}
 
+	t.withAccessLog(sess.log, RouteProxy, target, clientConn, func(conn net.Conn) {
+		t.relay(sess, "", 1, conn)
+	})
+	return nil
+}
+
+func (t *Transport) sendConnect(ctx context.Context, sess *tunnelSession, flags byte, target string) error {
+	if len(target) > 65535 {
+		return fmt.Errorf("target address too long")
+	}
+	body, backing, err := t.buildUploadChunk(sess.upAEAD, 0, flags, []byte(target), nil)
+	if err != nil {
+		return err
+	}
+	defer t.putFrameBuffer(backing)
+
+	start := time.Now()
+	dur, err := t.sendChunk(ctx, sess, body)
+	if err == nil && sess.ws != nil {
+		err = sess.ws.readStatus(ctx)
+		dur = time.Since(start)
+	}
+	if err != nil && sess.ws != nil {
+		_ = sess.ws.Close()
+	}
+	var dialErr *DialError
+	t.Pool.ReportRuntimeResult(sess.serverIP, err == nil || errors.As(err, &dialErr), dur)
+	return err
+}
+
+// relay pumps data in both directions until either side closes. When
+// startSeq is 0 the first upload frame carries target.
+func (t *Transport) relay(sess *tunnelSession, target string, startSeq uint32, clientConn net.Conn) {
 	done := make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 	var doneOnce sync.Once
@@ -103,14 +369,13 @@ func (t *Transport) Tunnel(target string, clientConn net.Conn) error {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		t.uploadLoop(ctx, destURL, hostHeader, sessionID, target, serverIP, clientConn, done, stop)
+		t.uploadLoop(ctx, sess, target, startSeq, clientConn, done, stop)
 	}()
 	go func() {
 		defer wg.Done()
-		t.downloadLoop(ctx, destURL, hostHeader, sessionID, clientConn, done, stop)
+		t.downloadLoop(ctx, sess, clientConn, done, stop)
 	}()
 	wg.Wait()
-	return nil
 }
 
 func newSessionID() string {
@@ -128,10 +393,10 @@ func (t *Transport) scheme() string {
 	return "http"
 }
 
-func (t *Transport) uploadLoop(ctx context.Context, baseURL, host, id, target, serverIP string, clientConn net.Conn, done chan struct{}, stop func()) {
+func (t *Transport) uploadLoop(ctx context.Context, sess *tunnelSession, target string, startSeq uint32, clientConn net.Conn, done chan struct{}, stop func()) {
 	targetBytes := []byte(target)
 	if len(targetBytes) > 65535 {
-		fmt.Printf("Upload chunk failed: target address too long\n")
+		sess.log.Warn("upload failed", "err", "target address too long")
 		stop()
 		return
 	}
@@ -139,8 +404,11 @@ func (t *Transport) uploadLoop(ctx context.Context, baseURL, host, id, target, s
 	readBuf := make([]byte, maxUploadChunkSize)
 	sizer := newAdaptiveChunkSizer(initialUploadChunkSize, minUploadChunkSize, maxUploadChunkSize)
 
-	var seq uint32
-	firstPacket := true
+	seq := startSeq
+	flags := uploadFlagFirst
+	if startSeq != 0 {
+		flags = 0
+	}
 	var sendWG sync.WaitGroup
 	sem := make(chan struct{}, uploadPipelineLimit)
 	defer sendWG.Wait()
@@ -164,9 +432,9 @@ readLoop:
 		_ = clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
 		n, err := clientConn.Read(readBuf[:chunkSize])
 		if n > 0 {
-			body, backing, errBuild := t.buildUploadChunk(seq, firstPacket, targetBytes, readBuf[:n])
+			body, backing, errBuild := t.buildUploadChunk(sess.upAEAD, seq, flags, targetBytes, readBuf[:n])
 			if errBuild != nil {
-				fmt.Printf("Upload chunk failed: %v\n", errBuild)
+				sess.log.Warn("upload failed", "err", errBuild)
 				stop()
 				break readLoop
 			}
@@ -186,16 +454,16 @@ readLoop:
 					t.putFrameBuffer(backing)
 				}()
 
-				dur, sendErr := t.sendChunk(ctx, baseURL, host, id, payload)
+				dur, sendErr := t.sendChunk(ctx, sess, payload)
 				sizer.Observe(dur, sendErr == nil)
-				t.Pool.ReportRuntimeResult(serverIP, sendErr == nil, dur)
+				t.Pool.ReportRuntimeResult(sess.serverIP, sendErr == nil, dur)
 				if sendErr != nil {
-					fmt.Printf("Upload chunk failed: %v\n", sendErr)
+					sess.log.Warn("upload failed", "err", sendErr)
 					stop()
 				}
 			}(body, backing)
 
-			firstPacket = false
+			flags = 0
 			seq++
 		}
 
@@ -210,30 +478,32 @@ readLoop:
 	_ = clientConn.SetReadDeadline(time.Time{})
 }
 
-func (t *Transport) buildUploadChunk(seq uint32, first bool, target []byte, data []byte) (body []byte, backing []byte, err error) {
+func (t *Transport) buildUploadChunk(aead cipher.AEAD, seq uint32, flags byte, target []byte, data []byte) (body []byte, backing []byte, err error) {
+	first := flags&uploadFlagFirst != 0
+	pad := 0
 	plainSize := uploadFrameHeader + len(data)
+	if t.Config.Padding > 0 {
+		flags |= uploadFlagPadded
+		pad = tunnel.PadLen(t.Config.Padding)
+		plainSize += tunnel.PadHeader + pad
+	}
 	if first {
 		plainSize += 2 + len(target)
 	}
-	totalSize := aes.BlockSize + plainSize
+	headerLen := 1 + aead.NonceSize()
+	totalSize := headerLen + plainSize + aead.Overhead()
 
 	backing = t.getFrameBuffer(totalSize)
-	body = backing[:totalSize]
-	iv := body[:aes.BlockSize]
-	if _, err := rand.Read(iv); err != nil {
-		t.putFrameBuffer(backing)
-		return nil, nil, err
-	}
-
-	plain := body[aes.BlockSize:]
+	plain := backing[headerLen : headerLen+plainSize]
 	binary.BigEndian.PutUint32(plain[0:4], seq)
-	if first {
-		plain[4] = uploadFlagFirst
-	} else {
-		plain[4] = 0
-	}
+	plain[4] = flags
 
 	offset := uploadFrameHeader
+	if flags&uploadFlagPadded != 0 {
+		binary.BigEndian.PutUint16(plain[offset:offset+tunnel.PadHeader], uint16(pad))
+		offset += tunnel.PadHeader
+		clear(plain[plainSize-pad:])
+	}
 	if first {
 		binary.BigEndian.PutUint16(plain[offset:offset+2], uint16(len(target)))
 		offset += 2
@@ -241,13 +511,15 @@ func (t *Transport) buildUploadChunk(seq uint32, first bool, target []byte, data
 		offset += len(target)
 	}
 	copy(plain[offset:offset+len(data)], data)
-	plain = plain[:offset+len(data)]
 
-	if err := crypto.XORCTRInPlace(t.secretKey, iv, plain); err != nil {
+	body, err = crypto.SealFrame(aead, backing, plainSize, nil)
+	if err != nil {
 		t.putFrameBuffer(backing)
 		return nil, nil, err
 	}
-	return body[:aes.BlockSize+len(plain)], backing, nil
+	t.stats.up.Add(int64(len(data)))
+	t.stats.padUp.Add(int64(pad))
+	return body, backing, nil
 }
 
 func (t *Transport) getFrameBuffer(size int) []byte {
@@ -266,33 +538,89 @@ func (t *Transport) putFrameBuffer(buf []byte) {
 	if buf == nil {
 		return
 	}
-	if cap(buf) > (aes.BlockSize+maxUploadChunkSize+uploadFrameHeader+2048)*2 {
+	if cap(buf) > (frameSlack+maxUploadChunkSize+uploadFrameHeader+2048)*2 {
 		return
 	}
 	t.framePool.Put(buf[:0])
 }
 
-func (t *Transport) sendChunk(ctx context.Context, baseURL, host, id string, data []byte) (time.Duration, error) {
+func (t *Transport) sendChunk(ctx context.Context, sess *tunnelSession, data []byte) (time.Duration, error) {
+	tunnel.Jitter(time.Duration(t.Config.JitterMS) * time.Millisecond)
 	start := time.Now()
-	url := fmt.Sprintf("%s/upload?session_id=%s", baseURL, id)
-	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
-	req.Host = host
-	req.Header.Set("Content-Type", "application/octet-stream")
+	if sess.ws != nil {
+		return time.Since(start), sess.ws.write(data)
+	}
+	req := sess.newRequest(ctx, t.Pool.shape, tunnel.RequestUpload, bytes.NewReader(data))
 
 	resp, err := t.Client.Do(req)
+	t.metrics.observeResponse(tunnel.RequestUpload, resp, err)
 	if err != nil {
 		return time.Since(start), err
 	}
 	defer resp.Body.Close()
-	_, _ = io.Copy(io.Discard, resp.Body)
 	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if resp.StatusCode == http.StatusBadGateway {
+			if code, ok := strings.CutPrefix(strings.TrimSpace(string(msg)), dialFailedPrefix); ok {
+				return time.Since(start), &DialError{Code: code}
+			}
+		}
 		return time.Since(start), fmt.Errorf("upload failed with status %s", resp.Status)
 	}
+	_, _ = io.Copy(io.Discard, resp.Body)
 	return time.Since(start), nil
 }
 
-func (t *Transport) downloadLoop(ctx context.Context, baseURL, host, id string, clientConn net.Conn, done chan struct{}, stop func()) {
-	url := fmt.Sprintf("%s/download?session_id=%s", baseURL, id)
+func (t *Transport) downloadLoop(ctx context.Context, sess *tunnelSession, clientConn io.Writer, done chan struct{}, stop func()) {
+	var nextSeq uint32
+
+	// deliver authenticates one frame and hands its payload on. A frame
+	// that fails authentication or arrives out of order means the stream
+	// can no longer be trusted, so the tunnel is torn down.
+	deliver := func(frame []byte) bool {
+		plain, err := crypto.OpenFrame(sess.downAEAD, frame, nil)
+		if err != nil || len(plain) < downloadFrameHeader {
+			sess.log.Warn("download frame rejected", "err", errOrShort(err))
+			stop()
+			return false
+		}
+		if seq := binary.BigEndian.Uint32(plain[0:4]); seq != nextSeq {
+			sess.log.Warn("download frame rejected", "seq", seq, "want", nextSeq)
+			stop()
+			return false
+		}
+		nextSeq++
+
+		data := plain[downloadFrameHeader:]
+		if t.Config.Padding > 0 {
+			// Our uploads are padded, so the server pads downloads.
+			if len(data) < tunnel.PadHeader {
+				sess.log.Warn("download frame rejected", "err", crypto.ErrFrameShort)
+				stop()
+				return false
+			}
+			pad := int(binary.BigEndian.Uint16(data))
+			if len(data) < tunnel.PadHeader+pad {
+				sess.log.Warn("download frame rejected", "padding", pad)
+				stop()
+				return false
+			}
+			data = data[tunnel.PadHeader : len(data)-pad]
+			t.stats.padDown.Add(int64(pad))
+		}
+		t.stats.down.Add(int64(len(data)))
+
+		if _, err := clientConn.Write(data); err != nil {
+			stop()
+			return false
+		}
+		return true
+	}
+
+	if sess.ws != nil {
+		t.wsDownloadLoop(sess, deliver, done, stop)
+		return
+	}
 
 	for {
 		select {
@@ -301,10 +629,24 @@ func (t *Transport) downloadLoop(ctx context.Context, baseURL, host, id string,
 		default:
 		}
 
-		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-		req.Host = host
+		streaming := t.streamDownloads()
+		req := sess.newRequest(ctx, t.Pool.shape, tunnel.RequestDownload, nil)
+		client := t.Client
+		// The server keeps frames until they are acknowledged here, so
+		// the ones of a lost response come again on the next request.
+		query := req.URL.Query()
+		query.Set("ack", strconv.FormatUint(uint64(nextSeq), 10))
+		if streaming {
+			query.Set("stream", "1")
+			// The response stays open for the server's stream lifetime, so
+			// the overall client timeout must not apply.
+			client = &http.Client{Transport: t.Client.Transport}
+		}
+		req.URL.RawQuery = query.Encode()
 
-		resp, err := t.Client.Do(req)
+		start := time.Now()
+		resp, err := client.Do(req)
+		t.metrics.observeResponse(tunnel.RequestDownload, resp, err)
 		if err != nil {
 			if ctx.Err() != nil {
 				return
@@ -323,32 +665,117 @@ func (t *Transport) downloadLoop(ctx context.Context, baseURL, host, id string,
 			continue
 		}
 
+		if resp.StatusCode == http.StatusGone {
+			resp.Body.Close()
+			stop()
+			return
+		}
+
 		if resp.StatusCode != http.StatusOK {
 			resp.Body.Close()
 			time.Sleep(200 * time.Millisecond)
 			continue
 		}
 
-		iv := make([]byte, aes.BlockSize)
-		if _, err := io.ReadFull(resp.Body, iv); err != nil {
+		if !streaming {
+			frame, err := io.ReadAll(resp.Body)
 			resp.Body.Close()
+			if err != nil {
+				continue
+			}
+			if !deliver(frame) {
+				return
+			}
 			continue
 		}
 
-		reader, err := crypto.NewCryptoReaderWithKey(resp.Body, t.secretKey, iv)
-		if err != nil {
-			resp.Body.Close()
-			continue
+		// Headers are flushed before any data, so a response that took
+		// this long to start was held back by something in the path.
+		if t.Config.DownloadMode != "stream" && time.Since(start) > streamBufferedThreshold {
+			if t.pollDownloads.CompareAndSwap(false, true) {
+				sess.log.Warn("streaming downloads appear to be buffered, falling back to polling")
+			}
 		}
-		if _, err := io.Copy(clientConn, reader); err != nil {
-			resp.Body.Close()
-			stop()
+
+		records, ok := readStream(resp.Body, deliver, sess.log)
+		resp.Body.Close()
+		if !ok {
 			return
 		}
-		resp.Body.Close()
+		if records == 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(downloadNoDataBackoff):
+			}
+		}
+	}
+}
+
+// readStream delivers the [len(4)][frame] records of a streaming download
+// response. It reports how many records were read and false if deliver
+// tore the tunnel down.
+func readStream(body io.Reader, deliver func([]byte) bool, log *slog.Logger) (int, bool) {
+	var lenBuf [4]byte
+	records := 0
+	for {
+		if _, err := io.ReadFull(body, lenBuf[:]); err != nil {
+			return records, true
+		}
+		size := binary.BigEndian.Uint32(lenBuf[:])
+		if size > maxDownloadFrame {
+			log.Warn("download frame rejected", "record", size)
+			return records, true
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(body, frame); err != nil {
+			return records, true
+		}
+		records++
+		if !deliver(frame) {
+			return records, false
+		}
 	}
 }
 
+func (t *Transport) streamDownloads() bool {
+	switch t.Config.DownloadMode {
+	case "poll":
+		return false
+	case "stream":
+		return true
+	default:
+		return !t.pollDownloads.Load()
+	}
+}
+
+func errOrShort(err error) error {
+	if err != nil {
+		return err
+	}
+	return crypto.ErrFrameShort
+}
+
+// Dial failure codes reported by the server after "dial failed: ".
+const (
+	dialFailedPrefix = "dial failed: "
+
+	DialRefused            = "refused"
+	DialHostUnreachable    = "host_unreachable"
+	DialNetworkUnreachable = "network_unreachable"
+	DialTimeout            = "timeout"
+	DialBlocked            = "blocked"
+)
+
+// DialError reports that the server could not connect to the target.
+type DialError struct {
+	Code string
+}
+
+func (e *DialError) Error() string {
+	return "server dial failed: " + e.Code
+}
+
 type adaptiveChunkSizer struct {
 	mu  sync.Mutex
 	cur int
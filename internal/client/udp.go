@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+)
+
+// udpAssociation is the client end of a SOCKS5 UDP ASSOCIATE: a local
+// datagram socket that only accepts packets from the host that opened the
+// control connection and replies to whichever port it last heard from.
+type udpAssociation struct {
+	conn     *net.UDPConn
+	clientIP net.IP
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	writeBuf   []byte
+}
+
+func newUDPAssociation(control net.Conn) (*udpAssociation, error) {
+	local, ok := control.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("control connection is not TCP")
+	}
+	remote, ok := control.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("control connection is not TCP")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		return nil, err
+	}
+	return &udpAssociation{conn: conn, clientIP: remote.IP}, nil
+}
+
+func (a *udpAssociation) LocalAddr() *net.UDPAddr {
+	return a.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// ReadDatagram returns the next datagram sent by the SOCKS client with its
+// SOCKS header stripped. Fragmented datagrams and packets from other hosts
+// are dropped.
+func (a *udpAssociation) ReadDatagram(buf []byte) (target string, data []byte, err error) {
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", nil, err
+		}
+		if !from.IP.Equal(a.clientIP) || n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		target, err := readSOCKSAddr(r)
+		if err != nil {
+			continue
+		}
+		a.mu.Lock()
+		a.clientAddr = from
+		a.mu.Unlock()
+		return target, buf[n-r.Len() : n], nil
+	}
+}
+
+// Write unpacks the tunnel datagram records in p and sends each to the
+// SOCKS client wrapped in a SOCKS5 UDP header.
+func (a *udpAssociation) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.clientAddr == nil {
+		return len(p), nil
+	}
+	n := len(p)
+	for len(p) > 0 {
+		from, data, rest, err := tunnel.NextDatagram(p)
+		if err != nil {
+			return 0, err
+		}
+		p = rest
+		packet, err := appendSOCKSAddr(append(a.writeBuf[:0], 0, 0, 0), from)
+		if err != nil {
+			continue
+		}
+		packet = append(packet, data...)
+		a.writeBuf = packet
+		if _, err := a.conn.WriteToUDP(packet, a.clientAddr); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (a *udpAssociation) Close() error {
+	return a.conn.Close()
+}
+
+// Associate opens a UDP session on the server and reports the outcome to
+// confirm, which typically writes the SOCKS reply. Datagrams are relayed
+// until the control connection closes or the server drops the association
+// for being idle.
+func (t *Transport) Associate(assoc *udpAssociation, control net.Conn, confirm func(error) error) error {
+	sess, err := t.newTunnelSession()
+	if err != nil {
+		_ = confirm(err)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Client.Timeout)
+	err = t.sendConnect(ctx, sess, uploadFlagFirst|uploadFlagUDP, "")
+	cancel()
+	if confirmErr := confirm(err); err == nil {
+		err = confirmErr
+	}
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	var doneOnce sync.Once
+	stop := func() {
+		doneOnce.Do(func() {
+			close(done)
+			cancel()
+			_ = assoc.Close()
+			_ = control.Close()
+		})
+	}
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		// The association lives as long as the TCP connection that asked
+		// for it; the client never sends anything else on it.
+		_, _ = io.Copy(io.Discard, control)
+		stop()
+	}()
+	go func() {
+		defer wg.Done()
+		t.udpUploadLoop(ctx, sess, assoc, done, stop)
+	}()
+	go func() {
+		defer wg.Done()
+		t.downloadLoop(ctx, sess, assoc, done, stop)
+	}()
+	wg.Wait()
+	return nil
+}
+
+// udpUploadLoop sends each datagram as its own upload frame so a lost or
+// slow request delays only that packet.
+func (t *Transport) udpUploadLoop(ctx context.Context, sess *tunnelSession, assoc *udpAssociation, done chan struct{}, stop func()) {
+	readBuf := make([]byte, tunnel.MaxDatagram+262)
+	record := make([]byte, 0, tunnel.MaxDatagram+262)
+	seq := uint32(1)
+	var sendWG sync.WaitGroup
+	sem := make(chan struct{}, uploadPipelineLimit)
+	defer sendWG.Wait()
+
+	for {
+		target, data, err := assoc.ReadDatagram(readBuf)
+		if err != nil {
+			stop()
+			return
+		}
+		if target, err = t.realTarget(target); err != nil {
+			continue
+		}
+		record = tunnel.AppendDatagram(record[:0], target, data)
+		body, backing, err := t.buildUploadChunk(sess.upAEAD, seq, 0, nil, record)
+		if err != nil {
+			sess.log.Warn("upload datagram failed", "err", err)
+			stop()
+			return
+		}
+		seq++
+
+		select {
+		case sem <- struct{}{}:
+		case <-done:
+			t.putFrameBuffer(backing)
+			return
+		}
+		sendWG.Add(1)
+		go func(payload, backing []byte) {
+			defer sendWG.Done()
+			defer func() {
+				<-sem
+				t.putFrameBuffer(backing)
+			}()
+			dur, sendErr := t.sendChunk(ctx, sess, payload)
+			t.Pool.ReportRuntimeResult(sess.serverIP, sendErr == nil, dur)
+			if sendErr != nil && ctx.Err() == nil {
+				sess.log.Warn("upload datagram failed", "err", sendErr)
+				stop()
+			}
+		}(body, backing)
+	}
+}
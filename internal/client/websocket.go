@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+)
+
+const (
+	// wsReadTimeout is how long a WebSocket may stay silent before it is
+	// considered dead. The server pings idle sessions every 30 seconds.
+	wsReadTimeout = 90 * time.Second
+
+	// wsWriteTimeout bounds each frame written, so a server that stops
+	// reading fails the session instead of blocking its uploads.
+	wsWriteTimeout = 30 * time.Second
+)
+
+// wsConn carries one tunnel session over a WebSocket. Binary messages are
+// the sealed upload and download frames; text messages are the status the
+// server would otherwise put in an HTTP response.
+type wsConn struct {
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+func (t *Transport) useWebSocket() bool {
+	return strings.EqualFold(strings.TrimSpace(t.Config.Transport), "ws")
+}
+
+// dialWebSocket opens the session's WebSocket with the same outbound
+// interface binding and TLS profile as the HTTP transport. The upgrade only
+// exists in HTTP/1.1, so that is all the handshake offers whatever
+// http_version says.
+func (t *Transport) dialWebSocket(ctx context.Context, sess *tunnelSession) (*wsConn, error) {
+	netDialer := newDialer(t.outboundInterface)
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: t.Client.Timeout,
+		ReadBufferSize:   64 * 1024,
+		WriteBufferSize:  64 * 1024,
+		NetDialContext:   netDialer.DialContext,
+	}
+	if t.Pool.tlsDialer != nil {
+		dialer.NetDialTLSContext = t.Pool.tlsDialer.DialContext(netDialer, "http/1.1")
+	}
+
+	req := sess.newRequest(ctx, t.Pool.shape, tunnel.RequestWebSocket, nil)
+	target := *req.URL
+	target.Scheme = "ws"
+	if t.Config.TLS {
+		target.Scheme = "wss"
+	}
+	header := req.Header.Clone()
+	if sess.host != "" {
+		header.Set("Host", sess.host)
+	}
+	conn, resp, err := dialer.DialContext(ctx, target.String(), header)
+	t.metrics.observeResponse(tunnel.RequestWebSocket, resp, err)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket upgrade failed with status %s", resp.Status)
+		}
+		return nil, err
+	}
+	conn.SetReadLimit(maxDownloadFrame)
+	return &wsConn{conn: conn}, nil
+}
+
+// write sends one frame. A failed write leaves the WebSocket unusable, so
+// it is closed, which also ends the download loop.
+func (c *wsConn) write(frame []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		_ = c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() { err = c.conn.Close() })
+	return err
+}
+
+// readStatus waits for the server's answer to a first frame.
+func (c *wsConn) readStatus(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetReadDeadline(deadline)
+		defer c.conn.SetReadDeadline(time.Time{})
+	}
+	for {
+		messageType, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if messageType == websocket.TextMessage {
+			return statusError(string(msg))
+		}
+	}
+}
+
+// statusError maps a text message from the server to an error, nil for
+// "ok".
+func statusError(msg string) error {
+	msg = strings.TrimSpace(msg)
+	if msg == "ok" {
+		return nil
+	}
+	if code, ok := strings.CutPrefix(msg, dialFailedPrefix); ok {
+		return &DialError{Code: code}
+	}
+	return fmt.Errorf("upload failed: %s", msg)
+}
+
+// wsDownloadLoop hands binary messages to deliver until the session ends.
+// Closing the WebSocket when done fires is what unblocks the read.
+func (t *Transport) wsDownloadLoop(sess *tunnelSession, deliver func([]byte) bool, done chan struct{}, stop func()) {
+	ws := sess.ws
+	defer stop()
+	defer ws.Close()
+
+	go func() {
+		<-done
+		_ = ws.Close()
+	}()
+
+	conn := ws.conn
+	_ = conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		ws.writeMu.Lock()
+		defer ws.writeMu.Unlock()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+
+	for {
+		messageType, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		if messageType == websocket.TextMessage {
+			if err := statusError(string(msg)); err != nil {
+				sess.log.Warn("tunnel closed by server", "err", err)
+				return
+			}
+			continue
+		}
+		if !deliver(msg) {
+			return
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/localapi"
+	"github.com/paulGUZU/fsak/pkg/logging"
+)
+
+// sessionInfo is a session as the admin API lists it.
+type sessionInfo struct {
+	ID            string       `json:"id"`
+	User          string       `json:"user,omitempty"`
+	Kind          string       `json:"kind,omitempty"`
+	Target        string       `json:"target,omitempty"`
+	Addr          string       `json:"addr,omitempty"`
+	AgeSeconds    float64      `json:"age_seconds"`
+	IdleSeconds   float64      `json:"idle_seconds"`
+	Up            int64        `json:"up"`
+	Down          int64        `json:"down"`
+	PendingUpload int          `json:"pending_upload"`
+	Closed        bool         `json:"closed,omitempty"`
+	Streams       []streamInfo `json:"streams,omitempty"`
+}
+
+type streamInfo struct {
+	ID         uint32  `json:"id"`
+	Target     string  `json:"target"`
+	Addr       string  `json:"addr,omitempty"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Up         int64   `json:"up"`
+	Down       int64   `json:"down"`
+}
+
+func (h *Handler) sessionInfo(s *Session, now time.Time) sessionInfo {
+	s.mu.Lock()
+	info := sessionInfo{
+		ID:            s.id,
+		User:          s.user.id,
+		Kind:          s.kind,
+		Target:        s.target,
+		Addr:          s.targetAddr,
+		AgeSeconds:    now.Sub(s.created).Seconds(),
+		IdleSeconds:   now.Sub(s.lastActive).Seconds(),
+		Up:            s.up.Load(),
+		Down:          s.down.Load(),
+		PendingUpload: len(s.pendingUpload),
+		Closed:        s.closed,
+	}
+	mux, _ := s.targetConn.(*muxServer)
+	s.mu.Unlock()
+
+	if mux != nil {
+		info.Streams = mux.streamInfos(now)
+	}
+	return info
+}
+
+// streamInfos lists the open streams, by id.
+func (m *muxServer) streamInfos(now time.Time) []streamInfo {
+	m.mu.Lock()
+	streams := make([]*serverStream, 0, len(m.streams))
+	for _, st := range m.streams {
+		streams = append(streams, st)
+	}
+	m.mu.Unlock()
+
+	infos := make([]streamInfo, 0, len(streams))
+	for _, st := range streams {
+		st.mu.Lock()
+		info := streamInfo{
+			ID:         st.id,
+			Target:     st.target,
+			Addr:       st.addr,
+			AgeSeconds: now.Sub(st.opened).Seconds(),
+		}
+		st.mu.Unlock()
+		info.Up, info.Down = st.up.Load(), st.down.Load()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Reload applies the users and egress sections of cfg without a restart.
+// Nothing changes when either is invalid. Sessions of removed users, and of
+// users whose secret changed, are closed; the rest keep running with the
+// new limits.
+func (h *Handler) Reload(cfg *config.Config) error {
+	policy, err := newEgressPolicy(cfg.Egress, h.resolver.LookupNetIP)
+	if err != nil {
+		return err
+	}
+	removed, rekeyed, err := h.users.reload(cfg)
+	if err != nil {
+		return err
+	}
+	policy.denied.Store(h.egress.Load().denied.Load())
+	h.egress.Store(policy)
+
+	if len(removed)+len(rekeyed) > 0 {
+		reasons := make(map[*userState]string, len(removed)+len(rekeyed))
+		for _, u := range removed {
+			reasons[u] = closeUserRemoved
+		}
+		for _, u := range rekeyed {
+			reasons[u] = closeKeyChanged
+		}
+		h.Sessions.Range(func(key, value any) bool {
+			s := value.(*Session)
+			if reason, ok := reasons[s.user]; ok {
+				h.closeSession(s, reason)
+				h.Sessions.Delete(key)
+			}
+			return true
+		})
+	}
+	h.logger.Info("configuration reloaded", "users", len(cfg.Users), "removed", len(removed), "rekeyed", len(rekeyed))
+	return nil
+}
+
+// AdminServer is the operator API: it lists and closes sessions, changes
+// the log level and reloads users and the egress policy.
+type AdminServer struct {
+	handler *Handler
+	reload  func() (*config.Config, error)
+	mux     http.Handler
+}
+
+// NewAdminServer serves the API for h. Requests must present token unless
+// it is empty. reload reads the configuration that POST /reload applies.
+func NewAdminServer(h *Handler, token string, reload func() (*config.Config, error)) *AdminServer {
+	a := &AdminServer{handler: h, reload: reload}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.listSessions)
+	mux.HandleFunc("GET /sessions/{id}", a.getSession)
+	mux.HandleFunc("DELETE /sessions/{id}", a.closeSession)
+	mux.HandleFunc("GET /log/level", a.getLogLevel)
+	mux.HandleFunc("PUT /log/level", a.setLogLevel)
+	mux.HandleFunc("POST /reload", a.reloadConfig)
+	a.mux = localapi.RequireToken(token, mux)
+	return a
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	user := r.URL.Query().Get("user")
+	sessions := []sessionInfo{}
+	a.handler.Sessions.Range(func(_, value any) bool {
+		s := value.(*Session)
+		if user == "" || s.user.id == user {
+			sessions = append(sessions, a.handler.sessionInfo(s, now))
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].AgeSeconds > sessions[j].AgeSeconds })
+	localapi.WriteJSON(w, http.StatusOK, sessions)
+}
+
+func (a *AdminServer) getSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.handler.GetSession(r.PathValue("id"))
+	if !ok {
+		localapi.WriteError(w, http.StatusNotFound, errors.New("no such session"))
+		return
+	}
+	localapi.WriteJSON(w, http.StatusOK, a.handler.sessionInfo(s, time.Now()))
+}
+
+func (a *AdminServer) closeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s, ok := a.handler.GetSession(id)
+	if !ok {
+		localapi.WriteError(w, http.StatusNotFound, errors.New("no such session"))
+		return
+	}
+	a.handler.closeSession(s, closeAdmin)
+	a.handler.Sessions.Delete(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (a *AdminServer) getLogLevel(w http.ResponseWriter, _ *http.Request) {
+	localapi.WriteJSON(w, http.StatusOK, logLevel{Level: strings.ToLower(logging.Level().String())})
+}
+
+func (a *AdminServer) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevel
+	if err := localapi.ReadJSON(r, &req); err != nil {
+		localapi.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := logging.SetLevel(req.Level); err != nil {
+		localapi.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.handler.logger.Info("log level changed", "level", strings.ToLower(logging.Level().String()))
+	localapi.WriteJSON(w, http.StatusOK, logLevel{Level: strings.ToLower(logging.Level().String())})
+}
+
+func (a *AdminServer) reloadConfig(w http.ResponseWriter, _ *http.Request) {
+	cfg, err := a.reload()
+	if err == nil {
+		err = a.handler.Reload(cfg)
+	}
+	if err != nil {
+		localapi.WriteError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/crypto"
+)
+
+const certWatchInterval = 30 * time.Second
+
+// CertReloader hands out the current certificate to new TLS handshakes and
+// swaps it when the files on disk change. Connections that are already
+// established keep the certificate they negotiated.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stopCh:   make(chan struct{}),
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate and key again. On failure the previous
+// certificate stays in use.
+func (c *CertReloader) Reload() error {
+	certMod, keyMod, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certMod = certMod
+	c.keyMod = keyMod
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch polls the certificate files and reloads them when either changes.
+func (c *CertReloader) Watch() {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		certMod, keyMod, err := c.modTimes()
+		if err != nil {
+			continue
+		}
+		c.mu.RLock()
+		changed := !certMod.Equal(c.certMod) || !keyMod.Equal(c.keyMod)
+		c.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.Reload(); err != nil {
+			slog.Error("certificate reload failed", "err", err)
+			continue
+		}
+		slog.Info("certificate reloaded", "file", c.certFile)
+	}
+}
+
+func (c *CertReloader) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+func (c *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// NewTLSConfig builds the listener TLS configuration from the server config.
+// It returns a nil config when TLS termination is not enabled, and a nil
+// reloader when the certificate is self-signed.
+func NewTLSConfig(cfg *config.Config) (*tls.Config, *CertReloader, error) {
+	certFile := strings.TrimSpace(cfg.CertFile)
+	keyFile := strings.TrimSpace(cfg.KeyFile)
+
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, nil, errors.New("both cert_file and key_file are required")
+		}
+		reloader, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}, reloader, nil
+	case cfg.SelfSigned:
+		cert, err := SelfSignedCertificate(cfg.Host, cfg.SNI)
+		if err != nil {
+			return nil, nil, err
+		}
+		slog.Info("using self-signed certificate", "spki_sha256", crypto.SPKIHash(cert.Leaf))
+		return &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}, nil, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// SelfSignedCertificate generates a throwaway ECDSA certificate valid for
+// the given names. It is meant for testing and for clients that pin the key.
+func SelfSignedCertificate(names ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+		if tmpl.Subject.CommonName == "localhost" {
+			tmpl.Subject.CommonName = name
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
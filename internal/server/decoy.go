@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+)
+
+// newDecoy builds the handler for requests that are not tunnel traffic.
+// Without a fallback it answers 404 like a web server with nothing at that
+// path.
+func newDecoy(cfg config.Fallback) (http.Handler, error) {
+	dir := strings.TrimSpace(cfg.Dir)
+	upstream := strings.TrimSpace(cfg.Upstream)
+	page := strings.TrimSpace(cfg.Page)
+
+	set := 0
+	for _, v := range []string{dir, upstream, page} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("fallback: set only one of dir, upstream and page")
+	}
+
+	switch {
+	case dir != "":
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("fallback dir: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("fallback dir %s is not a directory", dir)
+		}
+		return http.FileServer(http.Dir(dir)), nil
+	case upstream != "":
+		return newUpstreamDecoy(upstream)
+	case page != "":
+		return newPageDecoy(page, cfg.Status)
+	default:
+		return http.NotFoundHandler(), nil
+	}
+}
+
+// newUpstreamDecoy mirrors another site. The upstream sees its own host name
+// and no forwarding headers, so what comes back is what a visitor of that
+// site would get.
+func newUpstreamDecoy(upstream string) (http.Handler, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("fallback upstream: %w", err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+		return nil, fmt.Errorf("fallback upstream %q must be an http or https URL", upstream)
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}, nil
+}
+
+// newPageDecoy answers every request with the same page, read once at
+// startup.
+func newPageDecoy(path string, status int) (http.Handler, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fallback page: %w", err)
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < 100 || status > 599 {
+		return nil, fmt.Errorf("fallback status %d is not an HTTP status", status)
+	}
+	contentType := http.DetectContentType(body)
+	modTime := time.Now()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if status == http.StatusOK {
+			// Conditional and range requests behave like a static file.
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+			return
+		}
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(body)
+		}
+	}), nil
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+)
+
+// errEgressDenied is returned for destinations the egress policy rejects.
+// Clients see it as the "blocked" dial code.
+var errEgressDenied = errors.New("destination not allowed by egress policy")
+
+const dialTimeout = 10 * time.Second
+
+// internalPrefixes are ranges that net/netip does not classify but that
+// never lead anywhere a client should reach through the server.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// egressPolicy decides which destinations the server connects to on behalf
+// of clients. Hostnames are resolved here and only addresses that pass are
+// dialed, so a name cannot be re-resolved to a blocked address afterwards.
+type egressPolicy struct {
+	allowNets    []netip.Prefix
+	allowDomains []string
+	denyNets     []netip.Prefix
+	denyDomains  []string
+	ports        []portRange
+	denyPorts    []portRange
+	blockPrivate bool
+
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+	denied atomic.Int64
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+func newEgressPolicy(cfg config.Egress, lookup func(ctx context.Context, host string) ([]netip.Addr, error)) (*egressPolicy, error) {
+	p := &egressPolicy{
+		blockPrivate: cfg.BlockPrivate,
+		lookup:       lookup,
+	}
+	var err error
+	if p.allowNets, p.allowDomains, err = parseEgressRules(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if p.denyNets, p.denyDomains, err = parseEgressRules(cfg.Deny); err != nil {
+		return nil, err
+	}
+	if p.ports, err = parsePortRanges(cfg.Ports); err != nil {
+		return nil, err
+	}
+	if p.denyPorts, err = parsePortRanges(cfg.DenyPorts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseEgressRules(rules []string) ([]netip.Prefix, []string, error) {
+	var nets []netip.Prefix
+	var domains []string
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if prefix, err := netip.ParsePrefix(rule); err == nil {
+			nets = append(nets, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(rule); err == nil {
+			nets = append(nets, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		domain := normalizeDomain(rule)
+		name := strings.TrimPrefix(domain, "*.")
+		if name == "" || strings.ContainsAny(name, "*/: ") {
+			return nil, nil, fmt.Errorf("invalid egress rule %q", rule)
+		}
+		domains = append(domains, domain)
+	}
+	return nets, domains, nil
+}
+
+func parsePortRanges(specs []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(specs))
+	for _, spec := range specs {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.ParseUint(lo, 10, 16)
+		to, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil || from == 0 || from > to {
+			return nil, fmt.Errorf("invalid egress port %q", spec)
+		}
+		ranges = append(ranges, portRange{uint16(from), uint16(to)})
+	}
+	return ranges, nil
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// matchDomain reports whether host is one of domains. "*.example.com"
+// matches the subdomains of example.com but not example.com itself.
+func matchDomain(domains []string, host string) bool {
+	for _, d := range domains {
+		if suffix, ok := strings.CutPrefix(d, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == d {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNets(nets []netip.Prefix, addr netip.Addr) bool {
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPorts(ranges []portRange, port uint16) bool {
+	for _, r := range ranges {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func isInternalAddr(addr netip.Addr) bool {
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() ||
+		matchNets(internalPrefixes, addr)
+}
+
+// resolve checks target ("host:port") and returns the addresses that may be
+// dialed, in resolver order. It fails with errEgressDenied when none may.
+func (p *egressPolicy) resolve(ctx context.Context, target string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if (len(p.ports) > 0 && !matchPorts(p.ports, uint16(port))) || matchPorts(p.denyPorts, uint16(port)) {
+		return nil, p.deny()
+	}
+
+	var addrs []netip.Addr
+	domainAllowed := false
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		host = normalizeDomain(host)
+		if matchDomain(p.denyDomains, host) {
+			return nil, p.deny()
+		}
+		domainAllowed = matchDomain(p.allowDomains, host)
+		if !domainAllowed && len(p.allowDomains) > 0 && len(p.allowNets) == 0 {
+			return nil, p.deny()
+		}
+		if addrs, err = p.lookup(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	allowAll := len(p.allowNets) == 0 && len(p.allowDomains) == 0
+	var out []netip.AddrPort
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if matchNets(p.denyNets, addr) {
+			continue
+		}
+		listed := matchNets(p.allowNets, addr)
+		if p.blockPrivate && isInternalAddr(addr) && !listed {
+			continue
+		}
+		if !allowAll && !domainAllowed && !listed {
+			continue
+		}
+		out = append(out, netip.AddrPortFrom(addr, uint16(port)))
+	}
+	if len(out) == 0 {
+		return nil, p.deny()
+	}
+	return out, nil
+}
+
+func (p *egressPolicy) deny() error {
+	p.denied.Add(1)
+	return errEgressDenied
+}
+
+// dialTCP connects to target through the policy, trying each permitted
+// address in turn.
+func (p *egressPolicy) dialTCP(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	addrs, err := p.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", addr.String())
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// udpAddr resolves a datagram destination through the policy.
+func (p *egressPolicy) udpAddr(target string) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	addrs, err := p.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(addrs[0]), nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// previousProcess is the process that handed its sockets over. It keeps
+// serving the sessions it had until they end, so requests for them that
+// reach this process are passed on to it over a unix socket. Once it has
+// finished they are refused: their tokens would otherwise open new
+// sessions here that the clients know nothing of.
+type previousProcess struct {
+	sessions map[string]struct{}
+	proxy    *httputil.ReverseProxy
+	done     atomic.Bool
+}
+
+// ServeHandoff keeps the handler's sessions going after their sockets were
+// handed to a new process. It drains the handler, serves it on a unix
+// socket the new process forwards those sessions' requests to, and writes
+// the socket's path and the session ids to w for ForwardSessions. The
+// returned server should be shut down once the sessions are closed.
+func (h *Handler) ServeHandoff(w io.Writer) (*http.Server, error) {
+	// The socket goes in a directory only this user can enter, so nobody
+	// else can connect to it or put their own in its place.
+	dir, err := os.MkdirTemp("", "fsak-handoff-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "sessions.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	srv := &http.Server{Handler: h}
+	go func() { _ = srv.Serve(handoffListener{l, dir}) }()
+
+	h.Drain()
+	bw := bufio.NewWriter(w)
+	bw.WriteString(path)
+	bw.WriteByte('\n')
+	h.Sessions.Range(func(key, _ any) bool {
+		bw.WriteString(key.(string))
+		bw.WriteByte('\n')
+		return true
+	})
+	if err := bw.Flush(); err != nil {
+		_ = srv.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+// handoffListener removes the socket's directory when it is closed.
+type handoffListener struct {
+	net.Listener
+	dir string
+}
+
+func (l handoffListener) Close() error {
+	err := l.Listener.Close()
+	_ = os.RemoveAll(l.dir)
+	return err
+}
+
+// ForwardSessions reads what ServeHandoff wrote in the process that handed
+// its sockets over. Requests for the sessions listed go to that process
+// from then on, until it stops serving them; then they get 410 and the
+// client opens a new session here.
+func (h *Handler) ForwardSessions(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	path := sc.Text()
+	sessions := make(map[string]struct{})
+	for sc.Scan() {
+		if id := sc.Text(); id != "" {
+			sessions[id] = struct{}{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	prev := &previousProcess{sessions: sessions}
+	prev.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = "previous"
+			pr.Out.Host = pr.In.Host
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+		// Streamed downloads are passed on frame by frame.
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && opErr.Op == "dial" {
+				// The previous process has finished.
+				prev.done.Store(true)
+			}
+			http.Error(w, "session closed", http.StatusGone)
+		},
+	}
+	h.previous.Store(prev)
+	h.logger.Info("forwarding sessions of the previous process", "count", len(sessions))
+	return nil
+}
+
+// forwardPrevious passes a request for a session of the previous process
+// on to it, and reports whether it did.
+func (h *Handler) forwardPrevious(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	prev := h.previous.Load()
+	if prev == nil {
+		return false
+	}
+	if _, ok := prev.sessions[sessionID]; !ok {
+		return false
+	}
+	if prev.done.Load() {
+		http.Error(w, "session closed", http.StatusGone)
+		return true
+	}
+	prev.proxy.ServeHTTP(w, r)
+	return true
+}
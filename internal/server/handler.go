@@ -1,190 +1,630 @@
 package server
 
 import (
-	"crypto/aes"
-	"crypto/rand"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/paulGUZU/fsak/pkg/config"
 	"github.com/paulGUZU/fsak/pkg/crypto"
+	"github.com/paulGUZU/fsak/pkg/tunnel"
 )
 
 const (
 	uploadFlagFirst      byte = 1
+	uploadFlagUDP        byte = 2 // session relays datagrams instead of a stream
+	uploadFlagMux        byte = 4 // session carries multiplexed streams
+	uploadFlagPadded     byte = 8 // frames carry [padLen(2)] and filler
 	uploadFrameMinHeader      = 5
+	downloadFrameHeader       = 4 // [seq(4)]
 	downloadChunkSize         = 256 * 1024
+
+	// defaultStreamLifetime bounds one streaming download response.
+	defaultStreamLifetime = 25 * time.Second
+
+	// maxUnackedBytes bounds the download frames a session keeps to re-send
+	// until the client acknowledges them.
+	maxUnackedBytes = 1 << 20
+
+	// frameSlack covers the version byte, nonce and tag of a sealed frame.
+	frameSlack = 64
+
+	// authMaxSkew bounds the clock difference accepted on a handshake.
+	authMaxSkew     = 2 * time.Minute
+	replayCacheSize = 65536
+
+	// defaultShutdownTimeout bounds how long Shutdown lets sessions drain.
+	defaultShutdownTimeout = 30 * time.Second
+	// drainCheckInterval is how often Shutdown looks for sessions that
+	// have ended.
+	drainCheckInterval = 250 * time.Millisecond
+)
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errDraining     = errors.New("server is shutting down")
 )
 
 type Session struct {
 	id         string
 	targetConn net.Conn
+	kind       string // "tcp", "udp" or "mux" once dialed
+	target     string // requested destination of a plain TCP session
+	targetAddr string // the address it resolved to and was dialed at
+	created    time.Time
 	lastActive time.Time
 	mu         sync.Mutex
 	closed     bool
+	user       *userState
+	released   bool
+	log        *slog.Logger // carries the session and user ids
+	up, down   atomic.Int64
+
+	upAEAD          cipher.AEAD
+	downAEAD        cipher.AEAD
+	nextUploadSeq   uint32
+	pendingUpload   map[uint32][]byte
+	draining        bool // one upload request at a time writes to the target
+	padded          bool // download frames carry padding too
+	targetDone      bool // everything the target sent has been read
+	nextDownloadSeq uint32
+	unacked         [][]byte // sealed download frames not yet acknowledged, oldest first
+	unackedSeq      uint32   // sequence number of unacked[0]
+	unackedBytes    int
+}
+
+// ackDownload drops the download frames the client has received, those
+// before the ack query parameter, and returns the ones it has not, oldest
+// first. It reports false when some of those are no longer kept, so the
+// stream cannot continue. Without the parameter everything counts as
+// received.
+func (s *Session) ackDownload(ack string) ([][]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.nextDownloadSeq
+	if ack != "" {
+		n, err := strconv.ParseUint(ack, 10, 32)
+		if err != nil || uint32(n) > s.nextDownloadSeq {
+			return nil, false
+		}
+		next = uint32(n)
+	}
+	for len(s.unacked) > 0 && s.unackedSeq < next {
+		s.unackedBytes -= len(s.unacked[0])
+		s.unacked[0] = nil
+		s.unacked = s.unacked[1:]
+		s.unackedSeq++
+	}
+	if len(s.unacked) == 0 {
+		s.unackedSeq = s.nextDownloadSeq
+	}
+	if next < s.unackedSeq {
+		return nil, false
+	}
+	return append([][]byte(nil), s.unacked...), true
+}
 
-	nextUploadSeq uint32
-	pendingUpload map[uint32][]byte
+// retainDownload keeps a copy of the frame just sealed until the client
+// acknowledges it. Past maxUnackedBytes the oldest ones are dropped; a
+// client that misses those cannot go on.
+func (s *Session) retainDownload(frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.unacked) == 0 {
+		s.unackedSeq = s.nextDownloadSeq - 1
+	}
+	s.unacked = append(s.unacked, append([]byte(nil), frame...))
+	s.unackedBytes += len(frame)
+	for s.unackedBytes > maxUnackedBytes && len(s.unacked) > 1 {
+		s.unackedBytes -= len(s.unacked[0])
+		s.unacked[0] = nil
+		s.unacked = s.unacked[1:]
+		s.unackedSeq++
+	}
 }
 
-func NewSession(id string) *Session {
+// NewSession creates a session whose frames are sealed with keys derived
+// from the user's master key and the session id. It logs to logger with the
+// session id, and the user id in multi-user mode, attached.
+func NewSession(id string, user *userState, logger *slog.Logger) (*Session, error) {
+	masterKey := user.key()
+	upAEAD, err := crypto.NewSessionAEAD(masterKey, id, crypto.LabelUpload)
+	if err != nil {
+		return nil, err
+	}
+	downAEAD, err := crypto.NewSessionAEAD(masterKey, id, crypto.LabelDownload)
+	if err != nil {
+		return nil, err
+	}
+	log := logger.With("session", id)
+	if user.id != "" {
+		log = log.With("user", user.id)
+	}
+	now := time.Now()
 	return &Session{
 		id:            id,
-		lastActive:    time.Now(),
+		created:       now,
+		lastActive:    now,
+		user:          user,
+		log:           log,
+		upAEAD:        upAEAD,
+		downAEAD:      downAEAD,
 		pendingUpload: make(map[uint32][]byte),
-	}
+	}, nil
 }
 
 type Handler struct {
 	Config   *config.Config
 	Sessions sync.Map
 
-	secretKey [32]byte
-	bufPool   sync.Pool
+	users    *userRegistry
+	shape    *tunnel.Shape
+	decoy    http.Handler
+	resolver *resolver
+	egress   atomic.Pointer[egressPolicy] // swapped on reload
+	bufPool  sync.Pool
+	replay   *replayCache
+	createMu sync.Mutex
+	metrics  *serverMetrics
+	logger   *slog.Logger
+
+	draining atomic.Bool                     // no new sessions once set
+	previous atomic.Pointer[previousProcess] // set after a handoff to this process
+	stop     chan struct{}                   // ends cleanupLoop
+	stopOnce sync.Once
 }
 
-func NewHandler(cfg *config.Config) *Handler {
+func NewHandler(cfg *config.Config) (*Handler, error) {
+	users, err := newUserRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	shape, err := tunnel.NewShape(cfg)
+	if err != nil {
+		return nil, err
+	}
+	decoy, err := newDecoy(cfg.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := newResolver(cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+	egress, err := newEgressPolicy(cfg.Egress, resolver.LookupNetIP)
+	if err != nil {
+		return nil, err
+	}
 	h := &Handler{
-		Config:    cfg,
-		secretKey: crypto.DeriveKey(cfg.Secret),
+		Config:   cfg,
+		logger:   slog.Default(),
+		users:    users,
+		shape:    shape,
+		decoy:    decoy,
+		resolver: resolver,
+		replay:   newReplayCache(replayCacheSize, authMaxSkew),
+		stop:     make(chan struct{}),
 		bufPool: sync.Pool{
-			New: func() any { return make([]byte, downloadChunkSize) },
+			New: func() any {
+				return make([]byte, frameSlack+downloadFrameHeader+tunnel.PadHeader+downloadChunkSize+tunnel.MaxPadding)
+			},
 		},
 	}
+	h.egress.Store(egress)
+	h.metrics = newServerMetrics(h)
 	go h.cleanupLoop()
-	return h
+	return h, nil
 }
 
 func (h *Handler) cleanupLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
 	for {
-		time.Sleep(1 * time.Minute)
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
 		h.Sessions.Range(func(key, value interface{}) bool {
 			s := value.(*Session)
 			s.mu.Lock()
-			if time.Since(s.lastActive) > 2*time.Minute {
-				if s.targetConn != nil {
-					_ = s.targetConn.Close()
-					s.targetConn = nil
-				}
-				s.closed = true
-				s.pendingUpload = nil
+			idle := time.Since(s.lastActive) > 2*time.Minute
+			s.mu.Unlock()
+			if idle {
+				h.closeSession(s, closeIdle)
 				h.Sessions.Delete(key)
 			}
-			s.mu.Unlock()
 			return true
 		})
+		if err := h.users.saveUsage(); err != nil {
+			h.logger.Error("failed to save usage", "err", err)
+		}
 	}
 }
 
-func (h *Handler) GetSession(id string) *Session {
-	v, _ := h.Sessions.LoadOrStore(id, NewSession(id))
-	return v.(*Session)
+// Drain makes the handler refuse new sessions with 503 while the existing
+// ones keep running.
+func (h *Handler) Drain() {
+	if !h.draining.Swap(true) {
+		h.logger.Info("draining sessions")
+	}
+}
+
+// Shutdown drains the handler and, until ctx is done, keeps serving the
+// existing sessions while they end on their own. Then it closes the rest
+// and their target connections, stops the idle cleanup and saves the usage
+// counters. Shut the HTTP servers down after it returns.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.Drain()
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	var err error
+	for err == nil && h.closeFinished() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	n := 0
+	h.Sessions.Range(func(key, value any) bool {
+		h.closeSession(value.(*Session), closeShutdown)
+		h.Sessions.Delete(key)
+		n++
+		return true
+	})
+	h.stopOnce.Do(func() { close(h.stop) })
+	if saveErr := h.users.saveUsage(); saveErr != nil {
+		err = errors.Join(err, saveErr)
+	}
+	h.logger.Info("sessions closed", "count", n)
+	return err
+}
+
+// closeFinished closes the sessions that have nothing left to do: those
+// whose target has closed, which otherwise wait for the idle cleanup, and
+// mux sessions without open streams, which would only wait for new ones.
+// It returns how many sessions are still open.
+func (h *Handler) closeFinished() int {
+	n := 0
+	h.Sessions.Range(func(key, value any) bool {
+		s := value.(*Session)
+		s.mu.Lock()
+		closed, done := s.closed, s.targetDone
+		mux, _ := s.targetConn.(*muxServer)
+		s.mu.Unlock()
+		switch {
+		case closed:
+		case done:
+			h.closeSession(s, closeTargetClosed)
+			h.Sessions.Delete(key)
+		case mux != nil && mux.idle():
+			h.closeSession(s, closeShutdown)
+			h.Sessions.Delete(key)
+		default:
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// ShutdownTimeout is how long the configuration lets sessions drain.
+func (h *Handler) ShutdownTimeout() time.Duration {
+	if h.Config.ShutdownTimeout > 0 {
+		return time.Duration(h.Config.ShutdownTimeout) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
+// closeSession tears down the target connection and gives the session's
+// slot back to its user. It is safe to call more than once; only the first
+// call's reason is counted.
+func (h *Handler) closeSession(s *Session, reason string) {
+	s.mu.Lock()
+	if s.targetConn != nil {
+		_ = s.targetConn.Close()
+		s.targetConn = nil
+	}
+	if !s.closed {
+		h.metrics.sessionsClosed.With(reason).Inc()
+		h.logClose(s, reason)
+	}
+	s.closed = true
+	s.pendingUpload = nil
+	s.unacked, s.unackedBytes = nil, 0
+	release := !s.released
+	s.released = true
+	s.mu.Unlock()
+
+	if release {
+		h.users.release(s.user)
+	}
+}
+
+// logClose records why s ended and, with the access log on, what it
+// carried. The session's mutex is held.
+func (h *Handler) logClose(s *Session, reason string) {
+	s.log.Debug("session closed", "reason", reason)
+	if !h.Config.Log.Access || s.kind == "" {
+		return
+	}
+	attrs := []any{"kind", s.kind}
+	if s.target != "" {
+		attrs = append(attrs, "target", s.target, "addr", s.targetAddr)
+	}
+	attrs = append(attrs,
+		"up", s.up.Load(),
+		"down", s.down.Load(),
+		"duration", s.lastActive.Sub(s.created).Round(time.Millisecond),
+		"reason", reason,
+	)
+	s.log.Info("access", attrs...)
+}
+
+func sessionKind(flags byte) string {
+	switch {
+	case flags&uploadFlagUDP != 0:
+		return "udp"
+	case flags&uploadFlagMux != 0:
+		return "mux"
+	default:
+		return "tcp"
+	}
+}
+
+func (h *Handler) GetSession(id string) (*Session, bool) {
+	v, ok := h.Sessions.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Session), true
+}
+
+// authorize checks the handshake token carried by every tunnel request and
+// returns the session it belongs to. A session is only created by a fresh,
+// never seen token; later requests must present a token with a valid MAC
+// for the same session id and user. errUnauthorized means the request
+// should get the decoy response; other errors are user limits.
+func (h *Handler) authorize(sessionID, token string) (*Session, error) {
+	tok, err := crypto.ParseAuthToken(token)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	user, ok := h.users.lookup(tok.UserID)
+	if !ok {
+		return nil, errUnauthorized
+	}
+	if err := tok.Verify(user.key(), sessionID); err != nil {
+		return nil, errUnauthorized
+	}
+	if s, ok := h.GetSession(sessionID); ok {
+		return h.checkSessionUser(s, user)
+	}
+
+	h.createMu.Lock()
+	defer h.createMu.Unlock()
+	if s, ok := h.GetSession(sessionID); ok {
+		return h.checkSessionUser(s, user)
+	}
+
+	now := time.Now()
+	if d := now.Sub(tok.Timestamp); d > authMaxSkew || d < -authMaxSkew {
+		return nil, errUnauthorized
+	}
+	if h.draining.Load() {
+		return nil, errDraining
+	}
+	if !h.replay.Add(tok, now) {
+		return nil, errUnauthorized
+	}
+	if err := h.users.acquire(user, now); err != nil {
+		return nil, err
+	}
+	s, err := NewSession(sessionID, user, h.logger)
+	if err != nil {
+		h.users.release(user)
+		return nil, errUnauthorized
+	}
+	h.Sessions.Store(sessionID, s)
+	h.metrics.sessionsCreated.Inc()
+	s.log.Debug("session opened")
+	return s, nil
+}
+
+func (h *Handler) checkSessionUser(s *Session, user *userState) (*Session, error) {
+	if s.user != user {
+		return nil, errUnauthorized
+	}
+	if err := user.check(time.Now()); err != nil {
+		h.closeSession(s, closeLimit)
+		return nil, err
+	}
+	return s, nil
+}
+
+// serveDecoy answers requests that are not authenticated tunnel traffic the
+// way an ordinary web server would.
+func (h *Handler) serveDecoy(w http.ResponseWriter, r *http.Request) {
+	h.decoy.ServeHTTP(w, r)
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	sessionID := r.URL.Query().Get("session_id")
-	if sessionID == "" {
-		http.Error(w, "missing session_id", http.StatusBadRequest)
+	kind, sessionID, auth := h.shape.Match(r)
+	rec := &statusRecorder{ResponseWriter: w}
+	label := "decoy"
+	defer func() {
+		h.metrics.responses.With(label, rec.code()).Inc()
+	}()
+	w = rec
+
+	if kind == 0 {
+		h.serveDecoy(w, r)
+		return
+	}
+	if h.forwardPrevious(w, r, sessionID) {
+		label = kind.String()
 		return
 	}
 
-	session := h.GetSession(sessionID)
+	session, err := h.authorize(sessionID, auth)
+	if err != nil {
+		if errors.Is(err, errUnauthorized) {
+			h.serveDecoy(w, r)
+			return
+		}
+		label = kind.String()
+		h.logger.Info("session refused", "session", sessionID, "err", err)
+		status := http.StatusForbidden
+		if errors.Is(err, errDraining) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	label = kind.String()
 	session.mu.Lock()
 	session.lastActive = time.Now()
 	session.mu.Unlock()
 
-	switch r.Method {
-	case http.MethodPost:
+	switch kind {
+	case tunnel.RequestUpload:
 		h.handleUpload(w, r, session)
-	case http.MethodGet:
+	case tunnel.RequestDownload:
 		h.handleDownload(w, r, session)
-	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case tunnel.RequestWebSocket:
+		if !websocket.IsWebSocketUpgrade(r) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		h.serveWebSocket(w, r, session)
 	}
 }
 
 func (h *Handler) handleUpload(w http.ResponseWriter, r *http.Request, s *Session) {
 	defer r.Body.Close()
 
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(r.Body, iv); err != nil {
-		http.Error(w, "failed to read iv", http.StatusBadRequest)
-		return
-	}
-
-	encryptedPayload, err := io.ReadAll(r.Body)
+	sealed, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read payload", http.StatusBadRequest)
 		return
 	}
-	if len(encryptedPayload) == 0 {
-		w.WriteHeader(http.StatusOK)
+
+	if _, err := h.acceptUpload(s, sealed); err != nil {
+		s.log.Debug("upload rejected", "status", err.status, "err", err.msg)
+		http.Error(w, err.msg, err.status)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	if err := crypto.XORCTRInPlace(h.secretKey, iv, encryptedPayload); err != nil {
-		http.Error(w, "crypto error", http.StatusInternalServerError)
-		return
+// uploadError is a rejected upload frame with the HTTP status that reports
+// it. The message doubles as the WebSocket status text.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+// acceptUpload authenticates one sealed upload frame, dials the target on
+// the first frame and writes queued payloads to the target in order. It
+// returns the frame's flags. The user's limits are checked on every frame,
+// since a WebSocket carries many of them after a single request.
+func (h *Handler) acceptUpload(s *Session, sealed []byte) (byte, *uploadError) {
+	if err := s.user.check(time.Now()); err != nil {
+		h.closeSession(s, closeLimit)
+		return 0, &uploadError{http.StatusForbidden, err.Error()}
+	}
+	frame, err := crypto.OpenFrame(s.upAEAD, sealed, nil)
+	if err != nil {
+		if errors.Is(err, crypto.ErrFrameVersion) {
+			return 0, &uploadError{http.StatusBadRequest, "unsupported frame version"}
+		}
+		return 0, &uploadError{http.StatusBadRequest, "invalid upload frame"}
 	}
 
-	seq, isFirst, targetAddr, payload, err := parseUploadFrame(encryptedPayload)
+	up, err := parseUploadFrame(frame)
 	if err != nil {
-		http.Error(w, "invalid upload frame", http.StatusBadRequest)
-		return
+		return 0, &uploadError{http.StatusBadRequest, "invalid upload frame"}
 	}
+	seq, flags := up.seq, up.flags
+	s.user.padding.Add(int64(up.padding))
 
 	s.mu.Lock()
 	if s.closed {
 		s.mu.Unlock()
-		http.Error(w, "session closed", http.StatusGone)
-		return
+		return 0, &uploadError{http.StatusGone, "session closed"}
 	}
 
 	if seq < s.nextUploadSeq {
 		s.mu.Unlock()
-		w.WriteHeader(http.StatusOK)
-		return
+		return flags, nil
+	}
+	if flags&uploadFlagPadded != 0 {
+		s.padded = true
 	}
 	if _, exists := s.pendingUpload[seq]; !exists {
 		// Keep a compact copy in pending map.
-		s.pendingUpload[seq] = append([]byte(nil), payload...)
+		s.pendingUpload[seq] = append([]byte(nil), up.payload...)
 	}
-	needDial := s.targetConn == nil && isFirst
+	h.metrics.reorderDepth.Observe(float64(len(s.pendingUpload) - 1))
+	needDial := s.targetConn == nil && flags&uploadFlagFirst != 0
 	s.mu.Unlock()
 
 	if needDial {
-		conn, dialErr := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+		conn, dialErr := h.dialTarget(s, flags, up.target)
 		if dialErr != nil {
-			http.Error(w, fmt.Sprintf("dial failed: %v", dialErr), http.StatusBadGateway)
-			return
+			s.log.Debug("dial failed", "target", up.target, "err", dialErr)
+			h.closeSession(s, closeDialFailed)
+			return 0, &uploadError{http.StatusBadGateway, "dial failed: " + dialErrorCode(dialErr)}
 		}
 		s.mu.Lock()
 		if s.closed {
 			s.mu.Unlock()
 			_ = conn.Close()
-			http.Error(w, "session closed", http.StatusGone)
-			return
+			return 0, &uploadError{http.StatusGone, "session closed"}
 		}
 		if s.targetConn == nil {
 			s.targetConn = conn
+			s.kind = sessionKind(flags)
+			if addr := conn.RemoteAddr(); addr != nil {
+				s.target, s.targetAddr = up.target, addr.String()
+			}
 		} else {
 			_ = conn.Close()
 		}
 		s.mu.Unlock()
 	}
 
+	// Frames may arrive out of order over pipelined requests. Whichever
+	// request finds the next one in sequence drains the queue, so writes
+	// reach the target in order even when requests overlap.
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return flags, nil
+	}
+	s.draining = true
+	s.mu.Unlock()
+
 	for {
 		s.mu.Lock()
 		conn := s.targetConn
 		data, ok := s.pendingUpload[s.nextUploadSeq]
 		if !ok || conn == nil {
+			s.draining = false
 			s.mu.Unlock()
 			break
 		}
@@ -197,50 +637,118 @@ func (h *Handler) handleUpload(w http.ResponseWriter, r *http.Request, s *Sessio
 		}
 		if _, writeErr := conn.Write(data); writeErr != nil {
 			s.mu.Lock()
-			if s.targetConn != nil {
-				_ = s.targetConn.Close()
-				s.targetConn = nil
-			}
-			s.closed = true
+			s.draining = false
 			s.mu.Unlock()
-			http.Error(w, "target connection closed", http.StatusBadGateway)
-			return
+			h.closeSession(s, closeTargetClosed)
+			return 0, &uploadError{http.StatusBadGateway, "target connection closed"}
 		}
+		s.user.up.Add(int64(len(data)))
+		s.up.Add(int64(len(data)))
+		h.metrics.bytes.With("up").Add(float64(len(data)))
 	}
 
-	w.WriteHeader(http.StatusOK)
+	return flags, nil
 }
 
-func parseUploadFrame(frame []byte) (seq uint32, isFirst bool, target string, payload []byte, err error) {
+// dialTarget opens the session's target: a TCP connection, a UDP relay for
+// associations, or a demultiplexer that dials each stream on demand.
+func (h *Handler) dialTarget(s *Session, flags byte, targetAddr string) (net.Conn, error) {
+	switch {
+	case flags&uploadFlagUDP != 0:
+		idle := time.Duration(h.Config.UDPIdleTimeout) * time.Second
+		return newUDPRelay(idle, &h.egress, func() { h.closeSession(s, closeUDPIdle) })
+	case flags&uploadFlagMux != 0:
+		return newMuxServer(h.dialTCP, s.log, h.Config.Log.Access), nil
+	default:
+		return h.dialTCP(targetAddr)
+	}
+}
+
+func (h *Handler) dialTCP(targetAddr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := h.egress.Load().dialTCP(targetAddr)
+	h.metrics.observeDial(start, err)
+	return conn, err
+}
+
+// dialErrorCode classifies a dial failure into the code the client maps to
+// a SOCKS5 reply.
+func dialErrorCode(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errEgressDenied):
+		return "blocked"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "network_unreachable"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return "host_unreachable"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "failed"
+	}
+}
+
+// uploadFrame is the decrypted content of an upload frame:
+// [seq(4)][flags(1)], [padLen(2)] if padded, [targetLen(2)][target] on the
+// first frame, then the payload and padLen filler bytes.
+type uploadFrame struct {
+	seq     uint32
+	flags   byte
+	target  string
+	payload []byte
+	padding int
+}
+
+// parseUploadFrame splits a decrypted upload frame. The first frame of a
+// stream session must name its target; UDP and mux sessions carry
+// destinations in their records instead.
+func parseUploadFrame(frame []byte) (uploadFrame, error) {
+	var up uploadFrame
 	if len(frame) < uploadFrameMinHeader {
-		return 0, false, "", nil, errors.New("frame too short")
+		return up, errors.New("frame too short")
 	}
 
-	seq = binary.BigEndian.Uint32(frame[0:4])
-	flags := frame[4]
-	isFirst = flags&uploadFlagFirst != 0
+	up.seq = binary.BigEndian.Uint32(frame[0:4])
+	up.flags = frame[4]
 	offset := uploadFrameMinHeader
 
-	if isFirst {
+	if up.flags&uploadFlagPadded != 0 {
+		if len(frame) < offset+tunnel.PadHeader {
+			return up, errors.New("missing pad len")
+		}
+		up.padding = int(binary.BigEndian.Uint16(frame[offset : offset+tunnel.PadHeader]))
+		offset += tunnel.PadHeader
+		if len(frame) < offset+up.padding {
+			return up, errors.New("invalid pad len")
+		}
+		frame = frame[:len(frame)-up.padding]
+	}
+
+	if up.flags&uploadFlagFirst != 0 {
 		if len(frame) < offset+2 {
-			return 0, false, "", nil, errors.New("missing target len")
+			return up, errors.New("missing target len")
 		}
 		targetLen := int(binary.BigEndian.Uint16(frame[offset : offset+2]))
 		offset += 2
 		if targetLen < 0 || len(frame) < offset+targetLen {
-			return 0, false, "", nil, errors.New("invalid target len")
+			return up, errors.New("invalid target len")
 		}
-		target = string(frame[offset : offset+targetLen])
+		up.target = string(frame[offset : offset+targetLen])
 		offset += targetLen
-		if strings.TrimSpace(target) == "" {
-			return 0, false, "", nil, errors.New("empty target")
+		if strings.TrimSpace(up.target) == "" && up.flags&(uploadFlagUDP|uploadFlagMux) == 0 {
+			return up, errors.New("empty target")
 		}
 	}
 
 	if offset > len(frame) {
-		return 0, false, "", nil, errors.New("invalid frame")
+		return up, errors.New("invalid frame")
 	}
-	return seq, isFirst, target, frame[offset:], nil
+	up.payload = frame[offset:]
+	return up, nil
 }
 
 func (h *Handler) handleDownload(w http.ResponseWriter, r *http.Request, s *Session) {
@@ -258,23 +766,146 @@ func (h *Handler) handleDownload(w http.ResponseWriter, r *http.Request, s *Sess
 		return
 	}
 
-	buf := h.bufPool.Get().([]byte)
-	defer h.bufPool.Put(buf)
+	// Frames the client did not receive, because a response was lost, are
+	// sent again before new ones.
+	query := r.URL.Query()
+	resend, ok := s.ackDownload(query.Get("ack"))
+	if !ok {
+		s.log.Debug("download frames lost", "ack", query.Get("ack"))
+		h.closeSession(s, closeFramesLost)
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	}
 
-	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	n, err := conn.Read(buf)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			w.WriteHeader(http.StatusNoContent)
+	if query.Get("stream") == "1" {
+		if flusher, ok := w.(http.Flusher); ok {
+			h.streamDownload(w, flusher, r, s, conn, resend)
 			return
 		}
-		if err == io.EOF {
-			w.WriteHeader(http.StatusNoContent)
+	}
+	if len(resend) > 0 {
+		w.Header().Set("Content-Type", h.shape.DownloadContentType())
+		_, _ = w.Write(resend[0])
+		return
+	}
+
+	pooled := h.bufPool.Get().([]byte)
+	defer h.bufPool.Put(pooled)
+
+	frame, err := h.readDownloadFrame(s, conn, pooled, time.Now().Add(3*time.Second))
+	if err != nil {
+		if errors.Is(err, errCrypto) {
+			http.Error(w, "crypto error", http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	s.retainDownload(frame)
+
+	w.Header().Set("Content-Type", h.shape.DownloadContentType())
+	_, _ = w.Write(frame)
+}
+
+// streamDownload keeps the response open and writes each sealed frame as a
+// [len(4)][frame] record as soon as target data arrives. The response ends
+// after streamLifetime so proxies and CDNs that cut long requests do not
+// see it as idle forever; the client simply opens the next one. Frames in
+// resend go first.
+func (h *Handler) streamDownload(w http.ResponseWriter, flusher http.Flusher, r *http.Request, s *Session, conn net.Conn, resend [][]byte) {
+	lifetime := time.Duration(h.Config.StreamLifetime) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultStreamLifetime
+	}
+	end := time.Now().Add(lifetime)
+
+	w.Header().Set("Content-Type", h.shape.DownloadContentType())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	pooled := h.bufPool.Get().([]byte)
+	defer h.bufPool.Put(pooled)
+
+	var lenBuf [4]byte
+	writeRecord := func(frame []byte) bool {
+		binary.BigEndian.PutUint32(lenBuf[:], uint32(len(frame)))
+		if _, err := w.Write(lenBuf[:]); err != nil {
+			return false
+		}
+		if _, err := w.Write(frame); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	for _, frame := range resend {
+		if !writeRecord(frame) {
+			return
+		}
+	}
+
+	for time.Now().Before(end) && r.Context().Err() == nil {
+		// A stream is checked against the user's limits between frames,
+		// as each poll is when it arrives.
+		if err := s.user.check(time.Now()); err != nil {
+			s.log.Debug("stream ended", "err", err)
+			h.closeSession(s, closeLimit)
+			return
+		}
+		deadline := time.Now().Add(3 * time.Second)
+		if deadline.After(end) {
+			deadline = end
+		}
+		frame, err := h.readDownloadFrame(s, conn, pooled, deadline)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+		s.retainDownload(frame)
+		if !writeRecord(frame) {
+			return
+		}
+
+		s.mu.Lock()
+		s.lastActive = time.Now()
+		s.mu.Unlock()
+	}
+}
+
+var errCrypto = errors.New("crypto error")
+
+// readDownloadFrame reads whatever target data is available by deadline,
+// up to downloadChunkSize, and seals it as the session's next download
+// frame inside pooled. The returned frame aliases pooled.
+func (h *Handler) readDownloadFrame(s *Session, conn net.Conn, pooled []byte, deadline time.Time) ([]byte, error) {
+	s.mu.Lock()
+	padded := s.padded
+	s.mu.Unlock()
+
+	// Target data is read straight into the plaintext region of the frame
+	// so it can be sealed in place. Padded frames have [padLen(2)] between
+	// the sequence number and the data.
+	headerLen := 1 + s.downAEAD.NonceSize()
+	plainHeader := downloadFrameHeader
+	if padded {
+		plainHeader += tunnel.PadHeader
+	}
+	buf := pooled[headerLen+plainHeader : headerLen+plainHeader+downloadChunkSize]
+
+	_ = conn.SetReadDeadline(deadline)
+	n, err := conn.Read(buf)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			s.mu.Lock()
+			s.targetDone = true
+			s.mu.Unlock()
+		}
+		return nil, err
+	}
 
 	total := n
 	for total < len(buf) {
@@ -283,34 +914,34 @@ func (h *Handler) handleDownload(w http.ResponseWriter, r *http.Request, s *Sess
 		if m > 0 {
 			total += m
 		}
-		if readErr != nil {
-			if netErr, ok := readErr.(net.Error); ok && netErr.Timeout() {
-				break
-			}
-			if readErr == io.EOF {
-				break
-			}
-			break
-		}
-		if m == 0 {
+		if readErr != nil || m == 0 {
 			break
 		}
 	}
 
-	iv := make([]byte, aes.BlockSize)
-	if _, err := rand.Read(iv); err != nil {
-		http.Error(w, "internal iv error", http.StatusInternalServerError)
-		return
-	}
-	payload := buf[:total]
-	if err := crypto.XORCTRInPlace(h.secretKey, iv, payload); err != nil {
-		http.Error(w, "crypto error", http.StatusInternalServerError)
-		return
-	}
+	s.user.down.Add(int64(total))
+	s.down.Add(int64(total))
+	h.metrics.bytes.With("down").Add(float64(total))
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	if _, err := w.Write(iv); err != nil {
-		return
+	s.mu.Lock()
+	seq := s.nextDownloadSeq
+	s.nextDownloadSeq++
+	s.mu.Unlock()
+
+	plainLen := plainHeader + total
+	if padded {
+		pad := tunnel.PadLen(h.Config.Padding)
+		binary.BigEndian.PutUint16(pooled[headerLen+downloadFrameHeader:], uint16(pad))
+		// The pooled buffer may hold another session's plaintext.
+		clear(pooled[headerLen+plainLen : headerLen+plainLen+pad])
+		plainLen += pad
+		s.user.padding.Add(int64(pad))
+	}
+	binary.BigEndian.PutUint32(pooled[headerLen:], seq)
+	frame, err := crypto.SealFrame(s.downAEAD, pooled, plainLen, nil)
+	if err != nil {
+		return nil, errCrypto
 	}
-	_, _ = w.Write(payload)
+	tunnel.Jitter(time.Duration(h.Config.JitterMS) * time.Millisecond)
+	return frame, nil
 }
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/crypto"
+)
+
+// newTestHandler returns a handler for the shared secret "secret".
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	h, err := NewHandler(&config.Config{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Close what is left straight away.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_ = h.Shutdown(ctx)
+	})
+	return h
+}
+
+func TestAuthorize(t *testing.T) {
+	key := crypto.DeriveKey("secret")
+	token := func(t *testing.T, key [32]byte, sessionID string, ts time.Time) string {
+		t.Helper()
+		tok, err := crypto.NewAuthToken(key, "", sessionID, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	tests := []struct {
+		name      string
+		key       [32]byte
+		tokenFor  string
+		sessionID string
+		skew      time.Duration
+		wantErr   error
+	}{
+		{name: "fresh", key: key, tokenFor: "s1", sessionID: "s1"},
+		{name: "behind within skew", key: key, tokenFor: "s1", sessionID: "s1", skew: -authMaxSkew + 5*time.Second},
+		{name: "ahead within skew", key: key, tokenFor: "s1", sessionID: "s1", skew: authMaxSkew - 5*time.Second},
+		{name: "too far behind", key: key, tokenFor: "s1", sessionID: "s1", skew: -authMaxSkew - 5*time.Second, wantErr: errUnauthorized},
+		{name: "too far ahead", key: key, tokenFor: "s1", sessionID: "s1", skew: authMaxSkew + 5*time.Second, wantErr: errUnauthorized},
+		{name: "other session", key: key, tokenFor: "s1", sessionID: "s2", wantErr: errUnauthorized},
+		{name: "other secret", key: crypto.DeriveKey("other"), tokenFor: "s1", sessionID: "s1", wantErr: errUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			s, err := h.authorize(tt.sessionID, token(t, tt.key, tt.tokenFor, time.Now().Add(tt.skew)))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("authorize error = %v, want %v", err, tt.wantErr)
+				}
+				if _, ok := h.GetSession(tt.sessionID); ok {
+					t.Fatal("refused token opened a session")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authorize: %v", err)
+			}
+			if got, ok := h.GetSession(tt.sessionID); !ok || got != s {
+				t.Fatal("session not registered")
+			}
+		})
+	}
+}
+
+func TestAuthorizeReplay(t *testing.T) {
+	h := newTestHandler(t)
+	tok, err := crypto.NewAuthToken(crypto.DeriveKey("secret"), "", "s1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := h.authorize("s1", tok)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	// The token goes on every request of its session.
+	if again, err := h.authorize("s1", tok); err != nil || again != s {
+		t.Fatalf("authorize for the open session = %v, %v", again, err)
+	}
+
+	// Once the session is gone the token cannot open it again.
+	h.closeSession(s, closeIdle)
+	h.Sessions.Delete("s1")
+	if _, err := h.authorize("s1", tok); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("replayed token: err = %v, want %v", err, errUnauthorized)
+	}
+}
+
+func TestAuthorizeDraining(t *testing.T) {
+	h := newTestHandler(t)
+	key := crypto.DeriveKey("secret")
+	open, err := crypto.NewAuthToken(key, "", "s1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.authorize("s1", open); err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+
+	h.Drain()
+	if _, err := h.authorize("s1", open); err != nil {
+		t.Fatalf("authorize for an open session while draining: %v", err)
+	}
+	tok, err := crypto.NewAuthToken(key, "", "s2", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.authorize("s2", tok); !errors.Is(err, errDraining) {
+		t.Fatalf("new session while draining: err = %v, want %v", err, errDraining)
+	}
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Listening sockets are inherited the way systemd passes them: LISTEN_FDS
+// descriptors starting at 3, named by the colon separated LISTEN_FDNAMES.
+// LISTEN_PID, when set, must be this process.
+const (
+	listenFDsStart = 3
+	readyFDEnv     = "FSAK_READY_FD" // where a handed-off process reports it serves
+	stateFDEnv     = "FSAK_STATE_FD" // where it reads what the previous process passes on
+	handoffTimeout = 30 * time.Second
+)
+
+// socketNames are the sockets the server listens on. Inherited ones named
+// otherwise, such as by systemd's default of the unit name, are "http" and
+// then "http3" by position.
+var socketNames = []string{"http", "http3", "metrics", "admin"}
+
+// Sockets hands out the server's listening sockets, reusing inherited ones,
+// and remembers them so Handoff can pass them on.
+type Sockets struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	names     []string
+	files     map[string]filer
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// InheritSockets takes the sockets passed by systemd socket activation or
+// by a previous server process. It clears the LISTEN_* variables so they do
+// not leak into child processes.
+func InheritSockets() *Sockets {
+	s := &Sockets{inherited: make(map[string]*os.File), files: make(map[string]filer)}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return s
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return s
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if !slices.Contains(socketNames, name) {
+			name = ""
+			if i < 2 {
+				name = socketNames[i]
+			}
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		if f == nil {
+			continue
+		}
+		if _, dup := s.inherited[name]; dup || name == "" {
+			_ = f.Close()
+			continue
+		}
+		s.inherited[name] = f
+	}
+	return s
+}
+
+// take removes the inherited socket called name.
+func (s *Sockets) take(name string) *os.File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.inherited[name]
+	delete(s.inherited, name)
+	return f
+}
+
+func (s *Sockets) remember(name string, l any) {
+	if f, ok := l.(filer); ok {
+		s.mu.Lock()
+		if _, seen := s.files[name]; !seen {
+			s.names = append(s.names, name)
+		}
+		s.files[name] = f
+		s.mu.Unlock()
+	}
+}
+
+// Listener returns the inherited stream socket called name, or the one
+// listen opens when there is none.
+func (s *Sockets) Listener(name string, listen func() (net.Listener, error)) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if f := s.take(name); f != nil {
+		if l, err = net.FileListener(f); err != nil {
+			err = fmt.Errorf("inherited %s socket: %w", name, err)
+		}
+		_ = f.Close()
+	} else {
+		l, err = listen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.remember(name, l)
+	return l, nil
+}
+
+// PacketConn returns the inherited datagram socket called name, or the one
+// listen opens when there is none.
+func (s *Sockets) PacketConn(name string, listen func() (net.PacketConn, error)) (net.PacketConn, error) {
+	var pc net.PacketConn
+	var err error
+	if f := s.take(name); f != nil {
+		if pc, err = net.FilePacketConn(f); err != nil {
+			err = fmt.Errorf("inherited %s socket: %w", name, err)
+		}
+		_ = f.Close()
+	} else {
+		pc, err = listen()
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.remember(name, pc)
+	return pc, nil
+}
+
+// Handoff starts the current executable again with the same arguments and
+// the listening sockets, and waits until it reports that it has taken them.
+// Then sendState writes what the new process reads from InheritedState;
+// when only that fails the process is returned along with the error. The
+// caller should stop accepting and shut down gracefully afterwards, leaving
+// new connections to the new process.
+func (s *Sockets) Handoff(sendState func(w io.Writer) error) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	names := append([]string(nil), s.names...)
+	var files []*os.File
+	for _, name := range names {
+		if ul, ok := s.files[name].(*net.UnixListener); ok {
+			// The socket file now belongs to the new process.
+			ul.SetUnlinkOnClose(false)
+		}
+		f, err := s.files[name].File()
+		if err != nil {
+			s.mu.Unlock()
+			closeFiles(files)
+			return nil, fmt.Errorf("%s socket: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+	defer closeFiles(files)
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	stateR, state, err := os.Pipe()
+	if err != nil {
+		_ = readyW.Close()
+		return nil, err
+	}
+	defer state.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW, stateR)
+	cmd.Env = append(handoffEnv(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		readyFDEnv+"="+strconv.Itoa(listenFDsStart+len(files)),
+		stateFDEnv+"="+strconv.Itoa(listenFDsStart+len(files)+1),
+	)
+	err = cmd.Start()
+	_ = readyW.Close()
+	_ = stateR.Close()
+	if err != nil {
+		return nil, err
+	}
+	go func() { _ = cmd.Wait() }()
+
+	// The new process writes a byte once it serves; EOF means it exited.
+	_ = ready.SetReadDeadline(time.Now().Add(handoffTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		_ = cmd.Process.Kill()
+		return nil, fmt.Errorf("new process did not become ready: %w", err)
+	}
+	_ = state.SetWriteDeadline(time.Now().Add(handoffTimeout))
+	if err := sendState(state); err != nil {
+		return cmd.Process, fmt.Errorf("passing state to the new process: %w", err)
+	}
+	return cmd.Process, nil
+}
+
+// handoffEnv is the environment without the variables Handoff sets.
+func handoffEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		switch name {
+		case "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", readyFDEnv, stateFDEnv:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// NotifyReady tells the process that handed its sockets off, if any, that
+// this one has taken them and is about to serve. Read InheritedState after
+// it and before serving.
+func NotifyReady() error {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", readyFDEnv, err)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	if f == nil {
+		return errors.New("ready pipe is not open")
+	}
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// InheritedState returns what the process that handed its sockets off
+// passes on, or nil when this process was not started by a handoff. Reads
+// fail if it does not arrive within handoffTimeout.
+func InheritedState() io.ReadCloser {
+	v := os.Getenv(stateFDEnv)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(stateFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil
+	}
+	if f := os.NewFile(uintptr(fd), "state"); f != nil {
+		_ = f.SetReadDeadline(time.Now().Add(handoffTimeout))
+		return f
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// NotifyHandoff does nothing: there is no signal to request a handoff on
+// this platform.
+func NotifyHandoff(c chan<- os.Signal) {}
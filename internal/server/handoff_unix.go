@@ -0,0 +1,15 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyHandoff relays SIGUSR2, which asks the server to hand its sockets
+// to a new process, to c.
+func NotifyHandoff(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
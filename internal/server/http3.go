@@ -0,0 +1,18 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// NewHTTP3Server serves handler over QUIC on the UDP port of addr. It shares
+// tlsConfig, and with it certificate reloads, with the TCP listener.
+func NewHTTP3Server(addr string, handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/metrics"
+)
+
+// Reasons a session is closed, as reported by fsak_server_sessions_closed_total.
+const (
+	closeIdle         = "idle"
+	closeLimit        = "limit"
+	closeDialFailed   = "dial_failed"
+	closeTargetClosed = "target_closed"
+	closeUDPIdle      = "udp_idle"
+	closeFramesLost   = "frames_lost"  // the client missed download frames no longer kept
+	closeAdmin        = "admin"        // closed through the admin API
+	closeUserRemoved  = "user_removed" // its user was dropped by a reload
+	closeKeyChanged   = "key_changed"  // its user's secret was changed by a reload
+	closeShutdown     = "shutdown"     // still open when the server stopped
+)
+
+// reorderBuckets bound how many upload frames wait for an earlier one.
+var reorderBuckets = []float64{0, 1, 2, 4, 8, 16, 32, 64}
+
+// serverMetrics are the counters the handler updates as it serves.
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	sessionsCreated *metrics.Counter
+	sessionsClosed  *metrics.CounterVec
+	bytes           *metrics.CounterVec
+	dialDuration    *metrics.HistogramVec
+	reorderDepth    *metrics.Histogram
+	responses       *metrics.CounterVec
+}
+
+func newServerMetrics(h *Handler) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		sessionsCreated: r.Counter("fsak_server_sessions_created_total",
+			"Tunnel sessions created.").With(),
+		sessionsClosed: r.Counter("fsak_server_sessions_closed_total",
+			"Tunnel sessions closed, by reason.", "reason"),
+		bytes: r.Counter("fsak_server_bytes_total",
+			"Tunnel payload bytes relayed, by direction (up is client to target).", "direction"),
+		dialDuration: r.Histogram("fsak_server_dial_duration_seconds",
+			"Time to resolve and connect to targets, by result.", metrics.DurationBuckets, "result"),
+		reorderDepth: r.Histogram("fsak_server_upload_reorder_depth",
+			"Upload frames queued for an earlier frame of their session when one arrives.", reorderBuckets).With(),
+		responses: r.Counter("fsak_server_http_responses_total",
+			"HTTP responses, by request kind and status code.", "kind", "code"),
+	}
+	r.GaugeFunc("fsak_server_sessions_active", "Open tunnel sessions.", func() float64 {
+		n := 0
+		h.Sessions.Range(func(_, value any) bool {
+			s := value.(*Session)
+			s.mu.Lock()
+			if !s.closed {
+				n++
+			}
+			s.mu.Unlock()
+			return true
+		})
+		return float64(n)
+	})
+	r.CounterFunc("fsak_server_egress_denied_total", "Destinations rejected by the egress policy.", func() float64 {
+		return float64(h.egress.Load().denied.Load())
+	})
+	return m
+}
+
+func (m *serverMetrics) observeDial(start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = dialErrorCode(err)
+	}
+	m.dialDuration.With(result).Observe(time.Since(start).Seconds())
+}
+
+// Metrics serves the handler's metrics in the Prometheus text format on
+// /metrics.
+func (h *Handler) Metrics() http.Handler {
+	return h.metrics.registry.Handler()
+}
+
+// statusRecorder remembers the status code a handler answered with. It
+// passes Flush and Hijack through so streaming downloads and WebSocket
+// upgrades keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// code is the status as a label: 101 for a hijacked upgrade, 200 when the
+// handler wrote nothing.
+func (w *statusRecorder) code() string {
+	switch {
+	case w.status != 0:
+		return strconv.Itoa(w.status)
+	case w.hijacked:
+		return "101"
+	default:
+		return "200"
+	}
+}
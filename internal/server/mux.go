@@ -0,0 +1,368 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+)
+
+// maxMuxStreams bounds how many streams one session may have open.
+const maxMuxStreams = 1024
+
+// muxServer demultiplexes the streams of one session. Like udpRelay it is
+// installed as the session's target connection: Write dispatches the mux
+// frames of an upload payload, Read hands out whole queued frames for the
+// next download.
+type muxServer struct {
+	dial   func(target string) (net.Conn, error)
+	log    *slog.Logger
+	access bool // log each stream's target, bytes and duration
+
+	mu       sync.Mutex
+	streams  map[uint32]*serverStream
+	out      []byte
+	notify   chan struct{}
+	deadline time.Time
+	closed   bool
+	done     chan struct{}
+}
+
+func newMuxServer(dial func(target string) (net.Conn, error), log *slog.Logger, access bool) *muxServer {
+	return &muxServer{
+		dial:    dial,
+		log:     log,
+		access:  access,
+		streams: make(map[uint32]*serverStream),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// idle reports whether no stream is open.
+func (m *muxServer) idle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams) == 0
+}
+
+// queue appends frames for the client and wakes a waiting download.
+func (m *muxServer) queue(appendFrames func([]byte) []byte) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.out = appendFrames(m.out)
+	m.mu.Unlock()
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *muxServer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		typ, id, data, rest, err := tunnel.NextMuxFrame(p)
+		if err != nil {
+			return 0, err
+		}
+		p = rest
+		m.dispatch(typ, id, data)
+	}
+	return n, nil
+}
+
+func (m *muxServer) dispatch(typ byte, id uint32, data []byte) {
+	m.mu.Lock()
+	st := m.streams[id]
+	m.mu.Unlock()
+
+	switch typ {
+	case tunnel.MuxOpen:
+		m.open(id, string(data))
+	case tunnel.MuxData:
+		if st != nil {
+			st.enqueue(append([]byte(nil), data...))
+		}
+	case tunnel.MuxClose:
+		if st != nil {
+			st.enqueue(nil)
+		}
+	case tunnel.MuxWindow:
+		if inc, err := tunnel.MuxWindowIncrement(data); err == nil && st != nil {
+			st.grant(inc)
+		}
+	}
+}
+
+func (m *muxServer) open(id uint32, target string) {
+	m.mu.Lock()
+	if _, exists := m.streams[id]; exists || m.closed {
+		m.mu.Unlock()
+		return
+	}
+	if len(m.streams) >= maxMuxStreams {
+		m.mu.Unlock()
+		m.queue(func(b []byte) []byte {
+			return tunnel.AppendMuxFrame(b, tunnel.MuxReply, id, []byte("failed"))
+		})
+		return
+	}
+	st := newServerStream(m, id)
+	m.streams[id] = st
+	m.mu.Unlock()
+
+	go st.run(target)
+}
+
+func (m *muxServer) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// Read blocks until frames are queued or the read deadline passes, then
+// copies as many whole frames as fit in p.
+func (m *muxServer) Read(p []byte) (int, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(m.out) > 0 {
+			n := tunnel.MuxPrefix(m.out, len(p))
+			if n > len(p) {
+				m.mu.Unlock()
+				return 0, errors.New("read buffer smaller than mux frame")
+			}
+			copy(p, m.out[:n])
+			m.out = append(m.out[:0], m.out[n:]...)
+			m.mu.Unlock()
+			return n, nil
+		}
+		deadline := m.deadline
+		m.mu.Unlock()
+
+		if err := m.wait(deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (m *muxServer) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-m.notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-m.done:
+		return net.ErrClosed
+	}
+}
+
+func (m *muxServer) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	streams := make([]*serverStream, 0, len(m.streams))
+	for _, st := range m.streams {
+		streams = append(streams, st)
+	}
+	m.streams = nil
+	m.out = nil
+	close(m.done)
+	m.mu.Unlock()
+
+	for _, st := range streams {
+		st.abort()
+	}
+	return nil
+}
+
+func (m *muxServer) SetReadDeadline(t time.Time) error {
+	m.mu.Lock()
+	m.deadline = t
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *muxServer) SetDeadline(t time.Time) error      { return m.SetReadDeadline(t) }
+func (m *muxServer) SetWriteDeadline(t time.Time) error { return nil }
+func (m *muxServer) LocalAddr() net.Addr                { return nil }
+func (m *muxServer) RemoteAddr() net.Addr               { return nil }
+
+// serverStream is one target connection inside a mux session. Data from
+// the client is written by a dedicated goroutine so a slow target cannot
+// stall the other streams, and target reads stop while the client's
+// window is exhausted.
+type serverStream struct {
+	mux    *muxServer
+	id     uint32
+	target string
+	addr   string // what target resolved to, once dialed
+	opened time.Time
+	up     atomic.Int64
+	down   atomic.Int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	conn    net.Conn
+	writeQ  [][]byte // a nil entry marks MuxClose
+	window  int
+	aborted bool
+}
+
+func newServerStream(m *muxServer, id uint32) *serverStream {
+	st := &serverStream{mux: m, id: id, window: tunnel.MuxInitialWindow, opened: time.Now()}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *serverStream) run(target string) {
+	conn, err := st.mux.dial(target)
+	if err != nil {
+		st.mux.log.Debug("dial failed", "stream", st.id, "target", target, "err", err)
+		st.mux.remove(st.id)
+		st.mux.queue(func(b []byte) []byte {
+			return tunnel.AppendMuxFrame(b, tunnel.MuxReply, st.id, []byte(dialErrorCode(err)))
+		})
+		return
+	}
+
+	st.mu.Lock()
+	if st.aborted {
+		st.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	st.conn = conn
+	st.target, st.addr = target, conn.RemoteAddr().String()
+	st.mu.Unlock()
+
+	st.mux.queue(func(b []byte) []byte {
+		return tunnel.AppendMuxFrame(b, tunnel.MuxReply, st.id, nil)
+	})
+	go st.writeLoop()
+	st.readLoop()
+}
+
+func (st *serverStream) readLoop() {
+	defer st.mux.remove(st.id)
+	defer st.abort()
+	if st.mux.access {
+		defer func() {
+			st.mux.log.Info("access", "kind", "stream", "stream", st.id, "target", st.target, "addr", st.addr,
+				"up", st.up.Load(), "down", st.down.Load(), "duration", time.Since(st.opened).Round(time.Millisecond))
+		}()
+	}
+
+	buf := make([]byte, tunnel.MuxMaxData)
+	for {
+		st.mu.Lock()
+		for st.window <= 0 && !st.aborted {
+			st.cond.Wait()
+		}
+		if st.aborted {
+			st.mu.Unlock()
+			return
+		}
+		limit := min(st.window, len(buf))
+		st.mu.Unlock()
+
+		n, err := st.conn.Read(buf[:limit])
+		if n > 0 {
+			st.mu.Lock()
+			st.window -= n
+			st.mu.Unlock()
+			st.down.Add(int64(n))
+			data := buf[:n]
+			st.mux.queue(func(b []byte) []byte {
+				return tunnel.AppendMuxFrame(b, tunnel.MuxData, st.id, data)
+			})
+		}
+		if err != nil {
+			st.mux.queue(func(b []byte) []byte {
+				return tunnel.AppendMuxFrame(b, tunnel.MuxClose, st.id, nil)
+			})
+			return
+		}
+	}
+}
+
+func (st *serverStream) writeLoop() {
+	for {
+		st.mu.Lock()
+		for len(st.writeQ) == 0 && !st.aborted {
+			st.cond.Wait()
+		}
+		if st.aborted {
+			st.mu.Unlock()
+			return
+		}
+		data := st.writeQ[0]
+		st.writeQ = st.writeQ[1:]
+		conn := st.conn
+		st.mu.Unlock()
+
+		if data == nil {
+			_ = conn.Close()
+			return
+		}
+		if _, err := conn.Write(data); err != nil {
+			_ = conn.Close()
+			return
+		}
+		n := len(data)
+		st.up.Add(int64(n))
+		st.mux.queue(func(b []byte) []byte {
+			return tunnel.AppendMuxWindow(b, st.id, n)
+		})
+	}
+}
+
+func (st *serverStream) enqueue(data []byte) {
+	st.mu.Lock()
+	st.writeQ = append(st.writeQ, data)
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *serverStream) grant(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+func (st *serverStream) abort() {
+	st.mu.Lock()
+	st.aborted = true
+	conn := st.conn
+	st.writeQ = nil
+	st.mu.Unlock()
+	st.cond.Broadcast()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/crypto"
+)
+
+type replayEntry struct {
+	nonce [crypto.AuthNonceSize]byte
+	ts    time.Time
+}
+
+// replayHeap orders entries by timestamp, oldest first.
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].ts.Before(h[j].ts) }
+func (h replayHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x any)        { *h = append(*h, x.(replayEntry)) }
+func (h *replayHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// replayCache remembers handshake nonces for as long as their timestamps
+// are acceptable. When it is full the entry with the oldest timestamp is
+// evicted and that timestamp becomes a floor: tokens at or below it are
+// refused, so evicted tokens cannot be replayed. The floor never rises
+// above the current time, so a token from a clock running ahead cannot
+// lock out clients with correct clocks.
+type replayCache struct {
+	mu     sync.Mutex
+	max    int
+	window time.Duration
+	seen   map[[crypto.AuthNonceSize]byte]struct{}
+	byTime replayHeap
+	floor  time.Time
+}
+
+func newReplayCache(max int, window time.Duration) *replayCache {
+	return &replayCache{
+		max:    max,
+		window: window,
+		seen:   make(map[[crypto.AuthNonceSize]byte]struct{}),
+	}
+}
+
+// Add records a token and reports whether it had not been seen before.
+func (c *replayCache) Add(tok crypto.AuthToken, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pruneLocked(now)
+	if !tok.Timestamp.After(c.floor) {
+		return false
+	}
+	if _, ok := c.seen[tok.Nonce]; ok {
+		return false
+	}
+
+	for len(c.byTime) >= c.max {
+		oldest := heap.Pop(&c.byTime).(replayEntry)
+		delete(c.seen, oldest.nonce)
+		floor := oldest.ts
+		if floor.After(now) {
+			floor = now
+		}
+		if floor.After(c.floor) {
+			c.floor = floor
+		}
+	}
+	c.seen[tok.Nonce] = struct{}{}
+	heap.Push(&c.byTime, replayEntry{nonce: tok.Nonce, ts: tok.Timestamp})
+	return true
+}
+
+func (c *replayCache) pruneLocked(now time.Time) {
+	cutoff := now.Add(-c.window)
+	for len(c.byTime) > 0 && c.byTime[0].ts.Before(cutoff) {
+		oldest := heap.Pop(&c.byTime).(replayEntry)
+		delete(c.seen, oldest.nonce)
+	}
+}
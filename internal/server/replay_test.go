@@ -0,0 +1,135 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/crypto"
+)
+
+func replayToken(nonce byte, ts time.Time) crypto.AuthToken {
+	var tok crypto.AuthToken
+	tok.Nonce[0] = nonce
+	tok.Timestamp = ts
+	return tok
+}
+
+func TestReplayCache(t *testing.T) {
+	// Token timestamps are whole seconds; the clock is half a second on.
+	base := time.Unix(1700000000, 0)
+	now := base.Add(500 * time.Millisecond)
+	const window = 2 * time.Minute
+
+	// Each step adds a token stamped base+ts at now+at and expects Add to
+	// report want.
+	type step struct {
+		nonce byte
+		ts    time.Duration
+		at    time.Duration
+		want  bool
+	}
+	tests := []struct {
+		name  string
+		max   int
+		steps []step
+	}{
+		{
+			name: "duplicate nonce",
+			max:  10,
+			steps: []step{
+				{nonce: 1, ts: -10 * time.Second, want: true},
+				{nonce: 2, ts: -10 * time.Second, want: true},
+				{nonce: 1, ts: -10 * time.Second, want: false},
+				{nonce: 1, ts: -5 * time.Second, want: false},
+			},
+		},
+		{
+			name: "eviction raises the floor",
+			max:  2,
+			steps: []step{
+				{nonce: 1, ts: -30 * time.Second, want: true},
+				{nonce: 2, ts: -20 * time.Second, want: true},
+				// Evicts nonce 1: its timestamp becomes the floor.
+				{nonce: 3, ts: -10 * time.Second, want: true},
+				{nonce: 1, ts: -30 * time.Second, want: false},
+				{nonce: 4, ts: -30 * time.Second, want: false},
+				{nonce: 5, ts: -40 * time.Second, want: false},
+				// Evicts nonce 2.
+				{nonce: 6, ts: -29 * time.Second, want: true},
+				{nonce: 2, ts: -20 * time.Second, want: false},
+				{nonce: 7, ts: -20 * time.Second, want: false},
+				{nonce: 8, ts: -19 * time.Second, want: true},
+			},
+		},
+		{
+			name: "floor stays at the current time",
+			max:  1,
+			steps: []step{
+				// A token from a clock running ahead, then honest ones
+				// that evict it.
+				{nonce: 1, ts: 90 * time.Second, want: true},
+				{nonce: 2, want: true},
+				{nonce: 3, ts: time.Second, at: time.Second, want: true},
+				{nonce: 4, ts: 2 * time.Second, at: 2 * time.Second, want: true},
+				{nonce: 4, ts: 2 * time.Second, at: 2 * time.Second, want: false},
+			},
+		},
+		{
+			name: "capped floor refuses older tokens",
+			max:  1,
+			steps: []step{
+				{nonce: 1, ts: 90 * time.Second, want: true},
+				{nonce: 2, want: true},
+				{nonce: 3, want: false},
+				{nonce: 4, ts: -time.Second, want: false},
+			},
+		},
+		{
+			name: "expired entries make room without raising the floor",
+			max:  2,
+			steps: []step{
+				{nonce: 1, ts: -100 * time.Second, want: true},
+				{nonce: 2, ts: -90 * time.Second, want: true},
+				// Both have left the window by now.
+				{nonce: 3, ts: 50 * time.Second, at: 60 * time.Second, want: true},
+				{nonce: 4, ts: 50 * time.Second, at: 60 * time.Second, want: true},
+				{nonce: 3, ts: 50 * time.Second, at: 60 * time.Second, want: false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newReplayCache(tt.max, window)
+			for i, s := range tt.steps {
+				got := c.Add(replayToken(s.nonce, base.Add(s.ts)), now.Add(s.at))
+				if got != s.want {
+					t.Fatalf("step %d: Add(nonce %d, ts %v) = %v, want %v", i, s.nonce, s.ts, got, s.want)
+				}
+				if len(c.byTime) > tt.max || len(c.seen) != len(c.byTime) {
+					t.Fatalf("step %d: %d entries, %d nonces, max %d", i, len(c.byTime), len(c.seen), tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayCachePrune(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newReplayCache(10, time.Minute)
+	for i := range 5 {
+		c.Add(replayToken(byte(i), now.Add(time.Duration(i)*10*time.Second)), now)
+	}
+	// At now+75s the window starts at now+15s: the first two have left it.
+	c.Add(replayToken(100, now.Add(70*time.Second)), now.Add(75*time.Second))
+	if len(c.byTime) != 4 {
+		t.Fatalf("%d entries after pruning, want 4", len(c.byTime))
+	}
+	for _, nonce := range []byte{0, 1} {
+		if _, ok := c.seen[replayToken(nonce, now).Nonce]; ok {
+			t.Errorf("nonce %d is still remembered", nonce)
+		}
+	}
+	if !c.floor.IsZero() {
+		t.Errorf("floor = %v, want none", c.floor)
+	}
+}
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+)
+
+const (
+	defaultDNSCacheSize = 4096
+	// systemDNSTTL is how long answers from the system resolver are
+	// cached, since it does not report TTLs.
+	systemDNSTTL = 60 * time.Second
+	maxDNSTTL    = time.Hour
+	dnsTimeout   = 5 * time.Second
+	maxDNSPacket = 65535
+)
+
+// Address family preferences for resolved names.
+const (
+	preferIPv4     = "ipv4"
+	preferIPv6     = "ipv6"
+	preferIPv4Only = "ipv4_only"
+	preferIPv6Only = "ipv6_only"
+)
+
+// dnsUpstream answers queries for one record type.
+type dnsUpstream interface {
+	lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error)
+	String() string
+}
+
+// resolver turns target host names into addresses for the egress policy.
+// Upstreams are tried in order until one answers, and answers are cached
+// for their TTL.
+type resolver struct {
+	upstreams []dnsUpstream
+	prefer    string
+	cache     *dnsCache
+}
+
+func newResolver(cfg config.DNS) (*resolver, error) {
+	r := &resolver{prefer: strings.ToLower(strings.TrimSpace(cfg.Prefer))}
+	switch r.prefer {
+	case "", preferIPv4, preferIPv6, preferIPv4Only, preferIPv6Only:
+	default:
+		return nil, fmt.Errorf("unknown dns prefer %q", cfg.Prefer)
+	}
+	for _, spec := range cfg.Upstreams {
+		u, err := parseDNSUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	if len(r.upstreams) == 0 {
+		r.upstreams = []dnsUpstream{systemUpstream{}}
+	}
+	size := cfg.CacheSize
+	if size == 0 {
+		size = defaultDNSCacheSize
+	}
+	if size > 0 {
+		r.cache = newDNSCache(size)
+	}
+	return r, nil
+}
+
+// parseDNSUpstream accepts "system", "udp://host[:port]" (or a bare
+// address), "tls://host[:port]" and "https://host/path".
+func parseDNSUpstream(spec string) (dnsUpstream, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "system" {
+		return systemUpstream{}, nil
+	}
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok {
+		scheme, rest = "udp", spec
+	}
+	switch scheme {
+	case "udp", "tcp":
+		return &wireUpstream{network: scheme, addr: withPort(rest, "53")}, nil
+	case "tls":
+		addr := withPort(rest, "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return &wireUpstream{network: "tcp", addr: addr, tls: &tls.Config{ServerName: host}}, nil
+	case "https":
+		u, err := url.Parse(spec)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid dns upstream %q", spec)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return &dohUpstream{url: u.String(), client: &http.Client{Timeout: dnsTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("unknown dns upstream %q", spec)
+	}
+}
+
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// LookupNetIP returns the addresses of host ordered by the preference.
+// Failures are *net.DNSError so dial errors classify them as unreachable.
+func (r *resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if r.cache != nil {
+		if addrs, ok := r.cache.get(host, time.Now()); ok {
+			return addrs, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	var lastErr error
+	for _, u := range r.upstreams {
+		addrs, ttl, err := r.query(ctx, u, host)
+		if err != nil {
+			lastErr = err
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				break
+			}
+			continue
+		}
+		if r.cache != nil {
+			r.cache.put(host, addrs, ttl, time.Now())
+		}
+		return addrs, nil
+	}
+	var dnsErr *net.DNSError
+	if errors.As(lastErr, &dnsErr) {
+		return nil, dnsErr
+	}
+	return nil, &net.DNSError{Err: lastErr.Error(), Name: host, IsTemporary: true}
+}
+
+// query asks one upstream for the families the preference allows and
+// merges the answers in preference order, IPv4 first by default.
+func (r *resolver) query(ctx context.Context, u dnsUpstream, host string) ([]netip.Addr, time.Duration, error) {
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	switch r.prefer {
+	case preferIPv6:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	case preferIPv4Only:
+		qtypes = qtypes[:1]
+	case preferIPv6Only:
+		qtypes = qtypes[1:]
+	}
+
+	type answer struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	answers := make([]answer, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := &answers[i]
+			a.addrs, a.ttl, a.err = u.lookup(ctx, host, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	var firstErr error
+	for _, a := range answers {
+		if a.err != nil {
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			continue
+		}
+		addrs = append(addrs, a.addrs...)
+		if len(a.addrs) > 0 && (ttl == 0 || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+	}
+	if len(addrs) == 0 {
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no such host", Name: host, Server: u.String(), IsNotFound: true}
+		}
+		return nil, 0, firstErr
+	}
+	return addrs, ttl, nil
+}
+
+type systemUpstream struct{}
+
+func (systemUpstream) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	network := "ip4"
+	if qtype == dnsmessage.TypeAAAA {
+		network = "ip6"
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return addrs, systemDNSTTL, nil
+}
+
+func (systemUpstream) String() string { return "system" }
+
+// wireUpstream speaks plain DNS over UDP (retrying over TCP when the
+// answer is truncated), TCP or TLS.
+type wireUpstream struct {
+	network string
+	addr    string
+	tls     *tls.Config
+}
+
+func (u *wireUpstream) String() string {
+	if u.tls != nil {
+		return "tls://" + u.addr
+	}
+	return u.network + "://" + u.addr
+}
+
+func (u *wireUpstream) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	query, id, err := buildDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	network := u.network
+	resp, err := u.exchange(ctx, network, query)
+	if err == nil && network == "udp" && truncated(resp) {
+		resp, err = u.exchange(ctx, "tcp", query)
+	}
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: u.String(), IsTemporary: true}
+	}
+	return parseDNSAnswer(resp, id, host, qtype, u.String())
+}
+
+func (u *wireUpstream) exchange(ctx context.Context, network string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if u.tls != nil {
+		tlsConn := tls.Client(conn, u.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxDNSPacket)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	// Stream transports prefix each message with its length.
+	msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dohUpstream speaks DNS over HTTPS (RFC 8484) with POST requests.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstream) String() string { return u.url }
+
+func (u *dohUpstream) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	query, id, err := buildDNSQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := u.exchange(ctx, query)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: u.url, IsTemporary: true}
+	}
+	return parseDNSAnswer(resp, id, host, qtype, u.url)
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDNSPacket))
+}
+
+func buildDNSQuery(host string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: "invalid host name", Name: host, IsNotFound: true}
+	}
+	var idBuf [2]byte
+	_, _ = rand.Read(idBuf[:])
+	id := binary.BigEndian.Uint16(idBuf[:])
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	return query, id, err
+}
+
+func truncated(resp []byte) bool {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	return err == nil && h.Truncated
+}
+
+// parseDNSAnswer extracts the qtype addresses from resp and the smallest
+// TTL among them.
+func parseDNSAnswer(resp []byte, id uint16, host string, qtype dnsmessage.Type, server string) ([]netip.Addr, time.Duration, error) {
+	fail := func(msg string, notFound bool) error {
+		return &net.DNSError{Err: msg, Name: host, Server: server, IsNotFound: notFound, IsTemporary: !notFound}
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil || h.ID != id || !h.Response {
+		return nil, 0, fail("malformed response", false)
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, fail("no such host", true)
+	default:
+		return nil, 0, fail("server returned "+h.RCode.String(), false)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, fail("malformed response", false)
+	}
+
+	var addrs []netip.Addr
+	ttl := maxDNSTTL
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, fail("malformed response", false)
+		}
+		switch {
+		case rh.Type == qtype && qtype == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, fail("malformed response", false)
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case rh.Type == qtype && qtype == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, fail("malformed response", false)
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		default:
+			// CNAMEs in the chain are followed by the upstream itself.
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, fail("malformed response", false)
+			}
+			continue
+		}
+		if d := time.Duration(rh.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return addrs, ttl, nil
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// dnsCache keeps answers until their TTL runs out. When it is full, expired
+// entries are dropped first, then arbitrary ones.
+type dnsCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache(max int) *dnsCache {
+	return &dnsCache{max: max, entries: make(map[string]dnsCacheEntry)}
+}
+
+func (c *dnsCache) get(host string, now time.Time) ([]netip.Addr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.expires) {
+		delete(c.entries, host)
+		return nil, false
+	}
+	return e.addrs, true
+}
+
+func (c *dnsCache) put(host string, addrs []netip.Addr, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: now.Add(ttl)}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/tunnel"
+)
+
+const defaultUDPIdleTimeout = 60 * time.Second
+
+// udpRelay is the server end of a SOCKS5 UDP association. It presents the
+// datagram socket as a stream of tunnel.Datagram records so sessions can
+// treat it like any other target connection: Write sends every record in
+// an upload payload, Read fills a download buffer with whole records.
+type udpRelay struct {
+	net.PacketConn
+
+	idleTimeout time.Duration
+	lastActive  atomic.Int64
+	onIdle      func()
+	egress      *atomic.Pointer[egressPolicy]
+
+	readMu  sync.Mutex
+	readBuf []byte
+	pending []byte // a record that did not fit the previous Read
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newUDPRelay(idleTimeout time.Duration, egress *atomic.Pointer[egressPolicy], onIdle func()) (*udpRelay, error) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	r := &udpRelay{
+		PacketConn:  pc,
+		idleTimeout: idleTimeout,
+		onIdle:      onIdle,
+		egress:      egress,
+		readBuf:     make([]byte, tunnel.MaxDatagram),
+		closed:      make(chan struct{}),
+	}
+	r.touch()
+	go r.watchIdle()
+	return r, nil
+}
+
+func (r *udpRelay) touch() {
+	r.lastActive.Store(time.Now().UnixNano())
+}
+
+// watchIdle ends the association once no datagram has passed in either
+// direction for idleTimeout.
+func (r *udpRelay) watchIdle() {
+	ticker := time.NewTicker(r.idleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closed:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, r.lastActive.Load())) > r.idleTimeout {
+				if r.onIdle != nil {
+					r.onIdle()
+				}
+				_ = r.Close()
+				return
+			}
+		}
+	}
+}
+
+func (r *udpRelay) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		addr, data, rest, err := tunnel.NextDatagram(p)
+		if err != nil {
+			return 0, err
+		}
+		p = rest
+		dst, err := r.egress.Load().udpAddr(addr)
+		if err != nil {
+			// An unresolvable or blocked destination only loses this
+			// datagram.
+			continue
+		}
+		if _, err := r.WriteTo(data, dst); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return 0, err
+			}
+			continue
+		}
+		r.touch()
+	}
+	return n, nil
+}
+
+// Read returns one or more whole records. A record larger than p is kept
+// for the next call rather than split.
+func (r *udpRelay) Read(p []byte) (int, error) {
+	r.readMu.Lock()
+	defer r.readMu.Unlock()
+
+	if r.pending != nil {
+		if len(r.pending) > len(p) {
+			return 0, errors.New("read buffer smaller than datagram")
+		}
+		n := copy(p, r.pending)
+		r.pending = nil
+		return n, nil
+	}
+
+	m, from, err := r.ReadFrom(r.readBuf)
+	if err != nil {
+		return 0, err
+	}
+	r.touch()
+	record := tunnel.AppendDatagram(nil, from.String(), r.readBuf[:m])
+	if len(record) > len(p) {
+		r.pending = record
+		return 0, nil
+	}
+	return copy(p, record), nil
+}
+
+func (r *udpRelay) RemoteAddr() net.Addr { return nil }
+
+func (r *udpRelay) Close() error {
+	err := net.ErrClosed
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		err = r.PacketConn.Close()
+	})
+	return err
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+	"github.com/paulGUZU/fsak/pkg/crypto"
+)
+
+var (
+	errUserDisabled    = errors.New("user disabled")
+	errUserExpired     = errors.New("user expired")
+	errQuotaExceeded   = errors.New("quota exceeded")
+	errTooManySessions = errors.New("too many sessions")
+)
+
+// userState is the runtime view of a configured user: its key, limits and
+// traffic counters. The key and limits are swapped as a whole on reload, so
+// sessions keep counting against the same state.
+type userState struct {
+	id       string
+	settings atomic.Pointer[userSettings]
+
+	up      atomic.Int64
+	down    atomic.Int64
+	padding atomic.Int64 // filler bytes in both directions, not in quota
+	active  int          // guarded by userRegistry.mu
+}
+
+type userSettings struct {
+	cfg config.User
+	key [32]byte
+}
+
+// newUserState starts the user's counters from the persisted usage, if
+// any.
+func newUserState(id string, settings *userSettings, usage map[string]usageRecord) *userState {
+	u := &userState{id: id}
+	u.settings.Store(settings)
+	if rec, ok := usage[id]; ok && id != "" {
+		u.up.Store(rec.Up)
+		u.down.Store(rec.Down)
+		u.padding.Store(rec.Padding)
+	}
+	return u
+}
+
+func (u *userState) cfg() config.User {
+	return u.settings.Load().cfg
+}
+
+func (u *userState) key() [32]byte {
+	return u.settings.Load().key
+}
+
+func (u *userState) usage() usageRecord {
+	return usageRecord{Up: u.up.Load(), Down: u.down.Load(), Padding: u.padding.Load()}
+}
+
+func (u *userState) usedBytes() int64 {
+	return u.up.Load() + u.down.Load()
+}
+
+// check reports why the user may not use the tunnel right now, if at all.
+func (u *userState) check(now time.Time) error {
+	cfg := u.cfg()
+	if !cfg.Enabled {
+		return errUserDisabled
+	}
+	if !cfg.ExpiresAt.IsZero() && now.After(cfg.ExpiresAt) {
+		return errUserExpired
+	}
+	if cfg.QuotaBytes > 0 && u.usedBytes() >= cfg.QuotaBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+type usageRecord struct {
+	Up      int64 `json:"up"`
+	Down    int64 `json:"down"`
+	Padding int64 `json:"padding,omitempty"`
+}
+
+// userRegistry holds all users known to the handler. Without configured
+// users it contains a single anonymous user keyed by the shared secret.
+type userRegistry struct {
+	mu        sync.Mutex
+	users     map[string]*userState
+	removed   map[string]usageRecord // counters of users dropped by a reload
+	usagePath string
+}
+
+func newUserRegistry(cfg *config.Config) (*userRegistry, error) {
+	settings, err := parseUsers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := loadUsage(cfg.UsageFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load usage: %w", err)
+	}
+	r := &userRegistry{
+		users:     make(map[string]*userState, len(settings)),
+		removed:   make(map[string]usageRecord),
+		usagePath: cfg.UsageFile,
+	}
+	for id, s := range settings {
+		r.users[id] = newUserState(id, s, usage)
+	}
+	return r, nil
+}
+
+// parseUsers validates the users section. Without users the shared secret
+// is the only, anonymous, user.
+func parseUsers(cfg *config.Config) (map[string]*userSettings, error) {
+	settings := make(map[string]*userSettings)
+	if len(cfg.Users) == 0 {
+		settings[""] = &userSettings{
+			cfg: config.User{Secret: cfg.Secret, Enabled: true},
+			key: crypto.DeriveKey(cfg.Secret),
+		}
+		return settings, nil
+	}
+
+	for _, u := range cfg.Users {
+		if u.ID == "" {
+			return nil, errors.New("user id is required")
+		}
+		if u.Secret == "" {
+			return nil, fmt.Errorf("user %q has no secret", u.ID)
+		}
+		if _, dup := settings[u.ID]; dup {
+			return nil, fmt.Errorf("duplicate user %q", u.ID)
+		}
+		settings[u.ID] = &userSettings{cfg: u, key: crypto.DeriveKey(u.Secret)}
+	}
+	return settings, nil
+}
+
+// reload applies the users section of cfg. Users that stay keep their
+// counters and sessions with the new key and limits; new ones start from
+// the usage file, or from where they left off if a reload removed them.
+// It returns the users that were removed and those whose secret changed.
+func (r *userRegistry) reload(cfg *config.Config) (removed, rekeyed []*userState, err error) {
+	settings, err := parseUsers(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	usage, err := loadUsage(r.usagePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load usage: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, u := range r.users {
+		if _, ok := settings[id]; !ok {
+			removed = append(removed, u)
+			delete(r.users, id)
+			if id != "" {
+				r.removed[id] = u.usage()
+			}
+		}
+	}
+	for id, s := range settings {
+		if u, ok := r.users[id]; ok {
+			if u.key() != s.key {
+				rekeyed = append(rekeyed, u)
+			}
+			u.settings.Store(s)
+			continue
+		}
+		if rec, ok := r.removed[id]; ok {
+			if usage == nil {
+				usage = make(map[string]usageRecord)
+			}
+			usage[id] = rec
+			delete(r.removed, id)
+		}
+		r.users[id] = newUserState(id, s, usage)
+	}
+	return removed, rekeyed, nil
+}
+
+func (r *userRegistry) lookup(id string) (*userState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	return u, ok
+}
+
+// acquire reserves a session slot for the user.
+func (r *userRegistry) acquire(u *userState, now time.Time) error {
+	if err := u.check(now); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limit := u.cfg().MaxSessions; limit > 0 && u.active >= limit {
+		return errTooManySessions
+	}
+	u.active++
+	return nil
+}
+
+func (r *userRegistry) release(u *userState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u.active > 0 {
+		u.active--
+	}
+}
+
+// saveUsage writes the byte counters of all named users to the usage file.
+// Records of users no longer configured are kept, so their usage is still
+// there should they be added back.
+func (r *userRegistry) saveUsage() error {
+	if r.usagePath == "" {
+		return nil
+	}
+	usage, err := loadUsage(r.usagePath)
+	if err != nil {
+		return fmt.Errorf("failed to load usage: %w", err)
+	}
+	if usage == nil {
+		usage = make(map[string]usageRecord)
+	}
+	r.mu.Lock()
+	for id, rec := range r.removed {
+		usage[id] = rec
+	}
+	for id, u := range r.users {
+		if id == "" {
+			continue
+		}
+		usage[id] = u.usage()
+	}
+	r.mu.Unlock()
+
+	payload, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.usagePath), 0o755); err != nil {
+		return err
+	}
+	tmp := r.usagePath + ".tmp"
+	if err := os.WriteFile(tmp, payload, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.usagePath)
+}
+
+func loadUsage(path string) (map[string]usageRecord, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var usage map[string]usageRecord
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsMaxMessage bounds one sealed upload frame received over WebSocket.
+	wsMaxMessage = 2 << 20
+	// wsPingInterval keeps idle sessions alive through CDNs that drop
+	// silent WebSocket connections.
+	wsPingInterval = 30 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  64 * 1024,
+	WriteBufferSize: 64 * 1024,
+	// Tunnel clients are not browsers; the session token authenticates
+	// them.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsSession serializes writes to one upgraded connection.
+type wsSession struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *wsSession) write(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// serveWebSocket carries a session over one full-duplex connection. Binary
+// messages are the same sealed frames as upload bodies and download
+// responses; text messages carry the status an HTTP response would have:
+// "ok" for a first frame, or the error text.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request, s *Session) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	ws := &wsSession{conn: conn}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxMessage)
+
+	var pumpOnce sync.Once
+
+	for {
+		messageType, sealed, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		s.mu.Lock()
+		s.lastActive = time.Now()
+		s.mu.Unlock()
+
+		flags, uploadErr := h.acceptUpload(s, sealed)
+		if uploadErr != nil {
+			s.log.Debug("upload rejected", "status", uploadErr.status, "err", uploadErr.msg)
+			_ = ws.write(websocket.TextMessage, []byte(uploadErr.msg))
+			if uploadErr.status != http.StatusBadRequest {
+				return
+			}
+			continue
+		}
+		if flags&uploadFlagFirst == 0 {
+			continue
+		}
+		if err := ws.write(websocket.TextMessage, []byte("ok")); err != nil {
+			return
+		}
+		// Download frames only start once the target exists and the
+		// first frame has been acknowledged.
+		pumpOnce.Do(func() { go h.pumpWebSocket(ws, s) })
+	}
+}
+
+// pumpWebSocket sends download frames as target data arrives until the
+// target or the connection goes away.
+func (h *Handler) pumpWebSocket(ws *wsSession, s *Session) {
+	defer ws.conn.Close()
+
+	pooled := h.bufPool.Get().([]byte)
+	defer h.bufPool.Put(pooled)
+
+	for {
+		if err := s.user.check(time.Now()); err != nil {
+			h.closeSession(s, closeLimit)
+			_ = ws.write(websocket.TextMessage, []byte(err.Error()))
+			return
+		}
+		s.mu.Lock()
+		conn := s.targetConn
+		s.mu.Unlock()
+		if conn == nil {
+			return
+		}
+
+		frame, err := h.readDownloadFrame(s, conn, pooled, time.Now().Add(wsPingInterval))
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.mu.Lock()
+				s.lastActive = time.Now()
+				s.mu.Unlock()
+				ws.writeMu.Lock()
+				err = ws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+				ws.writeMu.Unlock()
+				if err != nil {
+					return
+				}
+				continue
+			}
+			return
+		}
+		if err := ws.write(websocket.BinaryMessage, frame); err != nil {
+			return
+		}
+	}
+}
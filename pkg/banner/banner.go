@@ -44,9 +44,14 @@ func PrintClientStatus(proxyPort int, serverAddr string, tls bool) {
 	fmt.Println(strings.Repeat("-", 50))
 }
 
-func PrintServerStatus(listenAddr string) {
+func PrintServerStatus(listenAddr string, tls bool) {
 	color.Green("✓ Server Started Successfully")
 	fmt.Printf("   • Mode:        Server\n")
 	fmt.Printf("   • Listening:   %s\n", listenAddr)
+	status := "Plaintext"
+	if tls {
+		status = "TLS/Secure"
+	}
+	fmt.Printf("   • Transport:   %s\n", status)
 	fmt.Println(strings.Repeat("-", 50))
 }
@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -13,35 +14,273 @@ type Config struct {
 	Port      int      `json:"port"`
 	ProxyPort int      `json:"proxy_port"`
 	Secret    string   `json:"secret"`
+
+	// PinSHA256 lists accepted base64 SHA-256 hashes of the server's public
+	// key. CAFile is a PEM bundle trusted instead of the system roots.
+	PinSHA256 []string `json:"pin_sha256,omitempty"`
+	CAFile    string   `json:"ca_file,omitempty"`
+
+	// ProxyBind is the address the local proxy listens on (default
+	// 127.0.0.1). ProxyUser and ProxyPass enable RFC 1929 authentication,
+	// and ProxyAllow restricts clients to the listed CIDRs.
+	ProxyBind  string   `json:"proxy_bind,omitempty"`
+	ProxyUser  string   `json:"proxy_user,omitempty"`
+	ProxyPass  string   `json:"proxy_pass,omitempty"`
+	ProxyAllow []string `json:"proxy_allow,omitempty"`
+
+	// Mux carries all TCP connections over MuxSessions shared tunnel
+	// sessions (default 2) instead of one session per connection. It is on
+	// unless set to false.
+	Mux         bool `json:"mux"`
+	MuxSessions int  `json:"mux_sessions,omitempty"`
+
+	// SOCKSOptimistic makes the local proxy report success before the
+	// server has dialed the target, trading error reporting for latency.
+	SOCKSOptimistic bool `json:"socks_optimistic,omitempty"`
+
+	// Routing decides per destination whether local proxy connections go
+	// through the tunnel, straight out or nowhere.
+	Routing Routing `json:"routing,omitempty"`
+
+	// LocalDNS runs a DNS server on the client that resolves through the
+	// tunnel.
+	LocalDNS LocalDNS `json:"local_dns,omitempty"`
+
+	// User identifies the client in the handshake when the server is
+	// configured with per-user secrets.
+	User string `json:"user,omitempty"`
+
+	// Users enables multi-user mode on the server. When empty, Secret is
+	// the only accepted key.
+	Users []User `json:"users,omitempty"`
+	// UsageFile is where the server persists per-user byte counters.
+	UsageFile string `json:"usage_file,omitempty"`
+
+	// CertFile and KeyFile make the server terminate TLS itself. SelfSigned
+	// generates a throwaway certificate instead, for testing.
+	CertFile   string `json:"cert_file,omitempty"`
+	KeyFile    string `json:"key_file,omitempty"`
+	SelfSigned bool   `json:"self_signed,omitempty"`
+
+	// Transport selects how sessions reach the server: "http" (default)
+	// upload/download requests, or "ws" for one WebSocket per session on
+	// WSPath (default "/ws").
+	Transport string `json:"transport,omitempty"`
+	WSPath    string `json:"ws_path,omitempty"`
+
+	// HTTPVersion is what the client speaks to the server: "1.1" (default),
+	// "2" (h2 over TLS, h2c otherwise) or "3" (QUIC, TLS only). The server
+	// always accepts HTTP/1.1 and HTTP/2, and HTTP/3 on the same UDP port
+	// when HTTP3 is set.
+	HTTPVersion string `json:"http_version,omitempty"`
+	HTTP3       bool   `json:"http3,omitempty"`
+
+	// Profile shapes tunnel requests. Client and server must agree on it.
+	Profile RequestProfile `json:"profile,omitempty"`
+
+	// Padding is the most random filler bytes added inside each frame a
+	// side sends (0 disables it, at most 16384). The server pads downloads
+	// only for clients that pad their uploads. JitterMS delays each frame
+	// by up to that many milliseconds.
+	Padding  int `json:"padding,omitempty"`
+	JitterMS int `json:"jitter_ms,omitempty"`
+
+	// Fallback is what the server shows to requests that are not tunnel
+	// traffic.
+	Fallback Fallback `json:"fallback,omitempty"`
+
+	// Egress limits the destinations the server connects to for clients.
+	Egress Egress `json:"egress,omitempty"`
+	// DNS controls how the server resolves target host names.
+	DNS DNS `json:"dns,omitempty"`
+
+	// StreamLifetime is how many seconds the server keeps a streaming
+	// download response open (default 25). DownloadMode selects the client
+	// side: "auto" (default) streams and falls back to polling when the
+	// responses turn out to be buffered, "stream" or "poll" force a mode.
+	StreamLifetime int    `json:"stream_lifetime,omitempty"`
+	DownloadMode   string `json:"download_mode,omitempty"`
+
+	// UDPIdleTimeout is how many seconds a UDP association may stay silent
+	// before the server drops it. Zero means 60.
+	UDPIdleTimeout int `json:"udp_idle_timeout,omitempty"`
+
+	// ShutdownTimeout is how many seconds the server lets sessions drain
+	// after SIGTERM or a listener handoff before closing them. Zero means 30.
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty"`
+
+	// MetricsListen (for example "127.0.0.1:9100") serves Prometheus
+	// metrics on /metrics. Empty disables it.
+	MetricsListen string `json:"metrics_listen,omitempty"`
+
+	// Log configures diagnostic output on both sides.
+	Log Log `json:"log,omitempty"`
+
+	// Admin enables the server's operator API.
+	Admin API `json:"admin,omitempty"`
+
+	// Control enables the client's control API, for status queries,
+	// reconnects and profile switches from scripts.
+	Control API `json:"control,omitempty"`
+}
+
+// RequestProfile describes what tunnel requests look like. Empty fields
+// keep the defaults: POST /upload and GET /download with the session in the
+// session_id and auth query parameters.
+//
+// Paths are templates; with SessionIn "path" the {session} and {auth}
+// segments carry the credentials and are appended when missing. With
+// "cookie" or "header", SessionName and AuthName name the cookies or
+// headers. Headers are added to every request.
+type RequestProfile struct {
+	UploadPath          string            `json:"upload_path,omitempty"`
+	UploadMethod        string            `json:"upload_method,omitempty"`
+	DownloadPath        string            `json:"download_path,omitempty"`
+	DownloadMethod      string            `json:"download_method,omitempty"`
+	SessionIn           string            `json:"session_in,omitempty"`
+	SessionName         string            `json:"session_name,omitempty"`
+	AuthName            string            `json:"auth_name,omitempty"`
+	Headers             map[string]string `json:"headers,omitempty"`
+	UploadContentType   string            `json:"upload_content_type,omitempty"`
+	DownloadContentType string            `json:"download_content_type,omitempty"`
+}
+
+// Routing holds the client's rules. The first rule that matches a
+// destination decides its action, and Default (default "proxy") applies
+// when none does. GeoIPFile and GeositeFile are text files with one
+// "code value" pair per line: a country code and a CIDR, or a category and
+// a domain. Resolve lets IP conditions match domain destinations by
+// resolving them locally, which sends those names to the local resolver.
+type Routing struct {
+	Rules       []Rule `json:"rules,omitempty"`
+	Default     string `json:"default,omitempty"`
+	Resolve     bool   `json:"resolve,omitempty"`
+	GeoIPFile   string `json:"geoip_file,omitempty"`
+	GeositeFile string `json:"geosite_file,omitempty"`
+}
+
+// Rule applies Action ("proxy", "direct" or "reject") to destinations
+// that match any of its address conditions and, when Ports is set, one of
+// its ports. Domain entries match the name and its subdomains.
+type Rule struct {
+	Action  string   `json:"action"`
+	Domain  []string `json:"domain,omitempty"`
+	Keyword []string `json:"keyword,omitempty"`
+	Regex   []string `json:"regex,omitempty"`
+	CIDR    []string `json:"cidr,omitempty"`
+	GeoIP   []string `json:"geoip,omitempty"`
+	Geosite []string `json:"geosite,omitempty"`
+	Ports   []string `json:"ports,omitempty"`
+}
+
+// LocalDNS configures the client's DNS listener. Listen (for example
+// "127.0.0.1:53") enables it on UDP and TCP. Queries travel through the
+// tunnel over TCP to Upstream (default "1.1.1.1:53") and answers are kept
+// for their TTL, up to CacheSize names (default 4096, negative disables
+// the cache). FakeIP answers A queries with addresses from FakeIPRange
+// (default 198.19.0.0/16) and remembers the name, so connections to them
+// are routed and tunneled by name.
+type LocalDNS struct {
+	Listen      string `json:"listen,omitempty"`
+	Upstream    string `json:"upstream,omitempty"`
+	CacheSize   int    `json:"cache_size,omitempty"`
+	FakeIP      bool   `json:"fake_ip,omitempty"`
+	FakeIPRange string `json:"fake_ip_range,omitempty"`
+}
+
+// Fallback selects the site the server poses as. At most one of Dir (a
+// static directory), Upstream (a site to reverse proxy) and Page (a file
+// served for every path, with Status, default 200) may be set. With none
+// the server answers 404.
+type Fallback struct {
+	Dir      string `json:"dir,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	Page     string `json:"page,omitempty"`
+	Status   int    `json:"status,omitempty"`
+}
+
+// Egress is the server's destination policy. Allow and Deny hold CIDRs,
+// addresses, domains or "*.example.com" wildcards; Deny wins, and a
+// non-empty Allow rejects everything it does not match. Ports lists the
+// permitted ports or ranges ("443", "8000-9000") and DenyPorts the rejected
+// ones. BlockPrivate, on unless set to false, rejects loopback, private,
+// link-local and other internal addresses that no Allow CIDR names.
+type Egress struct {
+	Allow        []string `json:"allow,omitempty"`
+	Deny         []string `json:"deny,omitempty"`
+	Ports        []string `json:"ports,omitempty"`
+	DenyPorts    []string `json:"deny_ports,omitempty"`
+	BlockPrivate bool     `json:"block_private"`
+}
+
+// DNS configures the server's resolver. Upstreams are tried in order until
+// one answers: "system" (the default), "udp://8.8.8.8" or a bare address,
+// "tls://1.1.1.1" (DNS over TLS, port 853) or "https://1.1.1.1/dns-query"
+// (DNS over HTTPS). Prefer orders dual-stack answers: "ipv4" (default) or
+// "ipv6" first, or "ipv4_only" / "ipv6_only" to drop the other family.
+// CacheSize caps how many names are cached for their TTL (default 4096,
+// negative disables the cache).
+type DNS struct {
+	Upstreams []string `json:"upstreams,omitempty"`
+	Prefer    string   `json:"prefer,omitempty"`
+	CacheSize int      `json:"cache_size,omitempty"`
+}
+
+// Log selects the log level ("debug", "info" (default), "warn" or
+// "error") and Format ("text" (default) or "json"). Access adds an
+// info-level record per connection with its target, byte counts and
+// duration.
+type Log struct {
+	Level  string `json:"level,omitempty"`
+	Format string `json:"format,omitempty"`
+	Access bool   `json:"access,omitempty"`
+}
+
+// API is a local management endpoint. Listen is a TCP address or
+// "unix:/path/to.sock". Requests must carry "Authorization: Bearer <Token>";
+// the token may only be left out on a unix socket, which is created
+// readable by its owner alone.
+type API struct {
+	Listen string `json:"listen,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// User is a server-side account with its own secret and limits. Zero
+// limits mean unlimited.
+type User struct {
+	ID          string    `json:"id"`
+	Secret      string    `json:"secret"`
+	Enabled     bool      `json:"enabled"`
+	QuotaBytes  int64     `json:"quota_bytes,omitempty"`
+	MaxSessions int       `json:"max_sessions,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+}
+
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plain User
+	aux := plain{Enabled: true}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*u = User(aux)
+	return nil
 }
 
 func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
 	aux := struct {
-		AddressesLegacy []string `json:"addressess"`
-		AddressesNew    []string `json:"addresses"`
-		Host            string   `json:"host"`
-		TLS             bool     `json:"tls"`
-		SNI             string   `json:"sni"`
-		Port            int      `json:"port"`
-		ProxyPort       int      `json:"proxy_port"`
-		Secret          string   `json:"secret"`
-	}{}
+		*plain
+		AddressesNew []string `json:"addresses"`
+	}{plain: (*plain)(c)}
+	c.Addresses = nil
+	c.Mux = true
+	c.Egress.BlockPrivate = true
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
 
-	c.Host = aux.Host
-	c.TLS = aux.TLS
-	c.SNI = aux.SNI
-	c.Port = aux.Port
-	c.ProxyPort = aux.ProxyPort
-	c.Secret = aux.Secret
-	if len(aux.AddressesLegacy) > 0 {
-		c.Addresses = aux.AddressesLegacy
-	} else if len(aux.AddressesNew) > 0 {
+	if len(c.Addresses) == 0 && len(aux.AddressesNew) > 0 {
 		c.Addresses = aux.AddressesNew
-	} else {
-		c.Addresses = nil
 	}
 	return nil
 }
@@ -0,0 +1,112 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// AuthNonceSize is the length of the random nonce carried in an auth token.
+const AuthNonceSize = 16
+
+const (
+	authTokenVersion byte = 2
+	authLabel             = "fsak auth"
+	authMACSize           = sha256.Size
+	authFixedSize         = 1 + 8 + AuthNonceSize + 1 // ver, ts, nonce, user len
+	maxAuthUserID         = 255
+)
+
+var ErrAuthToken = errors.New("invalid auth token")
+
+// AuthToken is the content of a session handshake token. It must be
+// checked with Verify before any of its fields are trusted.
+type AuthToken struct {
+	UserID    string
+	Timestamp time.Time
+	Nonce     [AuthNonceSize]byte
+
+	signed []byte
+	mac    []byte
+}
+
+// NewAuthToken returns a token proving knowledge of the user's master key
+// for the given session. The layout is
+// [ver(1)][unix ts(8)][nonce(16)][user len(1)][user][mac(32)], base64url
+// encoded, where mac is HMAC-SHA256 over everything before it and the
+// session id.
+func NewAuthToken(master [32]byte, userID, sessionID string, now time.Time) (string, error) {
+	if len(userID) > maxAuthUserID {
+		return "", errors.New("user id too long")
+	}
+	signedLen := authFixedSize + len(userID)
+	buf := make([]byte, signedLen+authMACSize)
+	buf[0] = authTokenVersion
+	binary.BigEndian.PutUint64(buf[1:9], uint64(now.Unix()))
+	if _, err := rand.Read(buf[9 : 9+AuthNonceSize]); err != nil {
+		return "", err
+	}
+	buf[9+AuthNonceSize] = byte(len(userID))
+	copy(buf[authFixedSize:], userID)
+
+	mac, err := authMAC(master, sessionID, buf[:signedLen])
+	if err != nil {
+		return "", err
+	}
+	copy(buf[signedLen:], mac)
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// ParseAuthToken decodes a token without authenticating it, so the caller
+// can look up the key of the claimed user.
+func ParseAuthToken(token string) (AuthToken, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) < authFixedSize+authMACSize || buf[0] != authTokenVersion {
+		return AuthToken{}, ErrAuthToken
+	}
+	userLen := int(buf[9+AuthNonceSize])
+	signedLen := authFixedSize + userLen
+	if len(buf) != signedLen+authMACSize {
+		return AuthToken{}, ErrAuthToken
+	}
+
+	tok := AuthToken{
+		UserID:    string(buf[authFixedSize:signedLen]),
+		Timestamp: time.Unix(int64(binary.BigEndian.Uint64(buf[1:9])), 0),
+		signed:    buf[:signedLen],
+		mac:       buf[signedLen:],
+	}
+	copy(tok.Nonce[:], buf[9:9+AuthNonceSize])
+	return tok, nil
+}
+
+// Verify checks the token MAC for the given session. Freshness and replay
+// checks are left to the caller.
+func (t AuthToken) Verify(master [32]byte, sessionID string) error {
+	if t.signed == nil {
+		return ErrAuthToken
+	}
+	want, err := authMAC(master, sessionID, t.signed)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(want, t.mac) {
+		return ErrAuthToken
+	}
+	return nil
+}
+
+func authMAC(master [32]byte, sessionID string, signed []byte) ([]byte, error) {
+	key, err := DeriveSessionKey(master, "", authLabel)
+	if err != nil {
+		return nil, err
+	}
+	m := hmac.New(sha256.New, key[:])
+	m.Write(signed)
+	m.Write([]byte(sessionID))
+	return m.Sum(nil), nil
+}
@@ -0,0 +1,138 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthToken(t *testing.T) {
+	master := DeriveKey("secret")
+	now := time.Unix(1700000000, 0)
+	token, err := NewAuthToken(master, "alice", "session", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userLen := 9 + AuthNonceSize
+
+	// flip returns the token with one byte changed.
+	flip := func(i int) string {
+		b := append([]byte(nil), raw...)
+		b[i] ^= 1
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	tests := []struct {
+		name      string
+		token     string
+		master    [32]byte
+		sessionID string
+		parseErr  bool
+		ok        bool
+	}{
+		{name: "valid", token: token, master: master, sessionID: "session", ok: true},
+		{name: "other session", token: token, master: master, sessionID: "session2"},
+		{name: "empty session", token: token, master: master, sessionID: ""},
+		{name: "other key", token: token, master: DeriveKey("other"), sessionID: "session"},
+		{name: "timestamp changed", token: flip(8), master: master, sessionID: "session"},
+		{name: "nonce changed", token: flip(9), master: master, sessionID: "session"},
+		{name: "user changed", token: flip(userLen + 1), master: master, sessionID: "session"},
+		{name: "mac changed", token: flip(len(raw) - 1), master: master, sessionID: "session"},
+		{name: "user length changed", token: flip(userLen), master: master, sessionID: "session", parseErr: true},
+		{name: "version changed", token: flip(0), master: master, sessionID: "session", parseErr: true},
+		{name: "truncated", token: encode(raw[:len(raw)-1]), master: master, sessionID: "session", parseErr: true},
+		{name: "trailing byte", token: encode(append(raw[:len(raw):len(raw)], 0)), master: master, sessionID: "session", parseErr: true},
+		{name: "header only", token: encode(raw[:userLen+1]), master: master, sessionID: "session", parseErr: true},
+		{name: "empty", token: "", master: master, sessionID: "session", parseErr: true},
+		{name: "not base64", token: "!" + token[1:], master: master, sessionID: "session", parseErr: true},
+		{name: "padded base64", token: base64.URLEncoding.EncodeToString(raw) + "=", master: master, sessionID: "session", parseErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := ParseAuthToken(tt.token)
+			if tt.parseErr {
+				if !errors.Is(err, ErrAuthToken) {
+					t.Fatalf("ParseAuthToken error = %v, want %v", err, ErrAuthToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAuthToken: %v", err)
+			}
+			err = tok.Verify(tt.master, tt.sessionID)
+			if tt.ok && err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrAuthToken) {
+				t.Fatalf("Verify error = %v, want %v", err, ErrAuthToken)
+			}
+		})
+	}
+}
+
+func TestAuthTokenFields(t *testing.T) {
+	master := DeriveKey("secret")
+	now := time.Unix(1700000000, 500)
+	a, err := NewAuthToken(master, "alice", "session", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewAuthToken(master, "alice", "session", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("two tokens for the same session are identical")
+	}
+
+	tok, err := ParseAuthToken(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.UserID != "alice" {
+		t.Errorf("UserID = %q, want alice", tok.UserID)
+	}
+	if want := now.Truncate(time.Second); !tok.Timestamp.Equal(want) {
+		t.Errorf("Timestamp = %v, want %v", tok.Timestamp, want)
+	}
+	if tok.Nonce == ([AuthNonceSize]byte{}) {
+		t.Error("Nonce is zero")
+	}
+}
+
+func TestAuthTokenUserID(t *testing.T) {
+	master := DeriveKey("secret")
+	now := time.Now()
+	for _, user := range []string{"", strings.Repeat("u", maxAuthUserID)} {
+		token, err := NewAuthToken(master, user, "session", now)
+		if err != nil {
+			t.Fatalf("NewAuthToken(%d byte user): %v", len(user), err)
+		}
+		tok, err := ParseAuthToken(token)
+		if err != nil {
+			t.Fatalf("ParseAuthToken(%d byte user): %v", len(user), err)
+		}
+		if tok.UserID != user {
+			t.Fatalf("UserID = %q, want %q", tok.UserID, user)
+		}
+		if err := tok.Verify(master, "session"); err != nil {
+			t.Fatalf("Verify(%d byte user): %v", len(user), err)
+		}
+	}
+	if _, err := NewAuthToken(master, strings.Repeat("u", maxAuthUserID+1), "session", now); err == nil {
+		t.Fatal("NewAuthToken accepted a user id longer than its length byte")
+	}
+}
+
+func TestAuthTokenUnparsed(t *testing.T) {
+	if err := (AuthToken{}).Verify(DeriveKey("secret"), "session"); !errors.Is(err, ErrAuthToken) {
+		t.Fatalf("Verify of a zero token = %v, want %v", err, ErrAuthToken)
+	}
+}
@@ -3,16 +3,116 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// FrameVersion is the first byte of every sealed tunnel frame. Bodies that
+// start with any other value come from an incompatible peer.
+const FrameVersion byte = 2
+
+// Labels used to derive per-direction session keys.
+const (
+	LabelUpload   = "fsak upload"
+	LabelDownload = "fsak download"
+)
+
+var (
+	ErrFrameVersion = errors.New("unsupported frame version")
+	ErrFrameShort   = errors.New("frame too short")
+)
+
 func DeriveKey(secret string) [32]byte {
 	return sha256.Sum256([]byte(secret))
 }
 
+// DeriveSessionKey expands the master key into a key bound to one session
+// and one direction using HKDF-SHA256.
+func DeriveSessionKey(master [32]byte, sessionID, label string) ([32]byte, error) {
+	var key [32]byte
+	out, err := hkdf.Key(sha256.New, master[:], []byte(sessionID), label, len(key))
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], out)
+	return key, nil
+}
+
+// NewSessionAEAD returns an AES-256-GCM instance keyed for a single session
+// direction.
+func NewSessionAEAD(master [32]byte, sessionID, label string) (cipher.AEAD, error) {
+	key, err := DeriveSessionKey(master, sessionID, label)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// FrameOverhead is the number of bytes a sealed frame adds to its plaintext.
+func FrameOverhead(aead cipher.AEAD) int {
+	return 1 + aead.NonceSize() + aead.Overhead()
+}
+
+// SealFrame encrypts the plaintext held in buf[1+NonceSize:] and writes the
+// frame [version][nonce][ciphertext+tag] into buf. buf must have room for
+// the tag after the plaintext. The returned slice aliases buf.
+func SealFrame(aead cipher.AEAD, buf []byte, plainLen int, ad []byte) ([]byte, error) {
+	headerLen := 1 + aead.NonceSize()
+	if cap(buf) < headerLen+plainLen+aead.Overhead() {
+		return nil, errors.New("frame buffer too small")
+	}
+	buf = buf[:headerLen+plainLen]
+	buf[0] = FrameVersion
+	nonce := buf[1:headerLen]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	plain := buf[headerLen:]
+	sealed := aead.Seal(buf[:headerLen], nonce, plain, frameAD(ad))
+	return sealed, nil
+}
+
+// OpenFrame authenticates and decrypts a frame produced by SealFrame. The
+// plaintext is decrypted in place and aliases frame.
+func OpenFrame(aead cipher.AEAD, frame []byte, ad []byte) ([]byte, error) {
+	headerLen := 1 + aead.NonceSize()
+	if len(frame) < 1 {
+		return nil, ErrFrameShort
+	}
+	if frame[0] != FrameVersion {
+		return nil, ErrFrameVersion
+	}
+	if len(frame) < headerLen+aead.Overhead() {
+		return nil, ErrFrameShort
+	}
+	nonce := frame[1:headerLen]
+	ciphertext := frame[headerLen:]
+	return aead.Open(ciphertext[:0], nonce, ciphertext, frameAD(ad))
+}
+
+// SPKIHash returns the base64 SHA-256 of the certificate's public key, the
+// value used for certificate pinning.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func frameAD(ad []byte) []byte {
+	out := make([]byte, 0, len(ad)+1)
+	out = append(out, FrameVersion)
+	return append(out, ad...)
+}
+
 // NewCipher creates a generic block cipher from the secret.
 // We use SHA-256 to hash the secret into a 32-byte key for AES-256.
 func NewGCM(secret string) (cipher.AEAD, error) {
@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+)
+
+func testAEAD(t *testing.T, secret, sessionID, label string) cipher.AEAD {
+	t.Helper()
+	aead, err := NewSessionAEAD(DeriveKey(secret), sessionID, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// sealTest seals plain the way the tunnel does: in a buffer that leaves
+// room for the header before the plaintext and the tag after it.
+func sealTest(t *testing.T, aead cipher.AEAD, plain, ad []byte) []byte {
+	t.Helper()
+	headerLen := 1 + aead.NonceSize()
+	buf := make([]byte, headerLen+len(plain), headerLen+len(plain)+aead.Overhead())
+	copy(buf[headerLen:], plain)
+	frame, err := SealFrame(aead, buf, len(plain), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestOpenFrame(t *testing.T) {
+	plain := []byte("frame payload")
+	aead := testAEAD(t, "secret", "session", LabelUpload)
+	headerLen := 1 + aead.NonceSize()
+
+	tests := []struct {
+		name    string
+		open    cipher.AEAD // defaults to the sealing AEAD
+		modify  func([]byte) []byte
+		ok      bool
+		wantErr error // checked when set; otherwise any error will do
+	}{
+		{name: "intact", ok: true},
+		{name: "version", modify: func(f []byte) []byte { f[0]++; return f }, wantErr: ErrFrameVersion},
+		{name: "nonce", modify: func(f []byte) []byte { f[1] ^= 1; return f }},
+		{name: "ciphertext", modify: func(f []byte) []byte { f[headerLen] ^= 1; return f }},
+		{name: "tag", modify: func(f []byte) []byte { f[len(f)-1] ^= 1; return f }},
+		{name: "empty", modify: func(f []byte) []byte { return f[:0] }, wantErr: ErrFrameShort},
+		{name: "version only", modify: func(f []byte) []byte { return f[:1] }, wantErr: ErrFrameShort},
+		{name: "shorter than a tag", modify: func(f []byte) []byte { return f[:headerLen+aead.Overhead()-1] }, wantErr: ErrFrameShort},
+		{name: "truncated by one byte", modify: func(f []byte) []byte { return f[:len(f)-1] }},
+		{name: "plaintext cut off", modify: func(f []byte) []byte { return append(f[:headerLen:headerLen], f[len(f)-aead.Overhead():]...) }},
+		{name: "trailing byte", modify: func(f []byte) []byte { return append(f, 0) }},
+		{name: "other direction", open: testAEAD(t, "secret", "session", LabelDownload)},
+		{name: "other session", open: testAEAD(t, "secret", "other", LabelUpload)},
+		{name: "other secret", open: testAEAD(t, "other", "session", LabelUpload)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := sealTest(t, aead, plain, nil)
+			if tt.modify != nil {
+				frame = tt.modify(frame)
+			}
+			open := aead
+			if tt.open != nil {
+				open = tt.open
+			}
+			got, err := OpenFrame(open, frame, nil)
+			switch {
+			case tt.ok:
+				if err != nil {
+					t.Fatalf("OpenFrame: %v", err)
+				}
+				if !bytes.Equal(got, plain) {
+					t.Fatalf("OpenFrame = %q, want %q", got, plain)
+				}
+			case err == nil:
+				t.Fatalf("OpenFrame accepted the frame: %q", got)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("OpenFrame error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenFrameAD(t *testing.T) {
+	aead := testAEAD(t, "secret", "session", LabelDownload)
+	frame := sealTest(t, aead, []byte("payload"), []byte("seq 1"))
+	if _, err := OpenFrame(aead, bytes.Clone(frame), []byte("seq 2")); err == nil {
+		t.Fatal("OpenFrame accepted different associated data")
+	}
+	if _, err := OpenFrame(aead, frame, []byte("seq 1")); err != nil {
+		t.Fatalf("OpenFrame: %v", err)
+	}
+}
+
+func TestSealFrameBufferTooSmall(t *testing.T) {
+	aead := testAEAD(t, "secret", "session", LabelUpload)
+	buf := make([]byte, 1+aead.NonceSize()+4)
+	if _, err := SealFrame(aead, buf, 4, nil); err == nil {
+		t.Fatal("SealFrame wrote past the buffer's capacity")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package localapi
+
+import "net"
+
+// listenUnix creates the socket. There are no file modes to restrict it
+// with on this platform.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package localapi
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix creates the socket with access for its owner only. The umask
+// applies from the start, where a chmod afterwards would leave a moment in
+// which anyone could connect.
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
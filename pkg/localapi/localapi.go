@@ -0,0 +1,75 @@
+// Package localapi holds what the server admin API and the client control
+// API share: the listener, token authentication and JSON replies.
+package localapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+)
+
+// Listen opens the API's listener. name is the config section, for error
+// messages. A unix socket left behind by an earlier run is replaced; a new
+// one is only accessible to the user running the process.
+func Listen(cfg config.API, name string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(cfg.Listen, "unix:")
+	if !isUnix {
+		if cfg.Token == "" {
+			return nil, fmt.Errorf("%s.token is required unless %s.listen is a unix socket", name, name)
+		}
+		return net.Listen("tcp", cfg.Listen)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return listenUnix(path)
+}
+
+// RequireToken rejects requests without "Authorization: Bearer <token>".
+// An empty token lets every request through.
+func RequireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WriteJSON sends v as the response body.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// WriteError sends err as {"error": "..."}.
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// ReadJSON decodes a request body of at most 64 KB into v.
+func ReadJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package logging builds the structured logger the client and server log
+// through.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+)
+
+// level is the level of the default logger installed by Setup.
+var level slog.LevelVar
+
+// New returns a logger writing to w at the configured level and format.
+func New(cfg config.Log, w io.Writer) (*slog.Logger, error) {
+	lvl, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	return newLogger(cfg, w, lvl)
+}
+
+// Setup builds the logger for cfg on w and makes it the default, which the
+// standard log package writes through as well. SetLevel changes its level
+// afterwards.
+func Setup(cfg config.Log, w io.Writer) (*slog.Logger, error) {
+	lvl, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	level.Set(lvl)
+	logger, err := newLogger(cfg, w, &level)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+func newLogger(cfg config.Log, w io.Writer, lvl slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(strings.TrimSpace(cfg.Format)) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+}
+
+// ParseLevel reads "debug", "info", "warn" or "error"; empty means info.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// Level returns the level of the logger installed by Setup.
+func Level() slog.Level {
+	return level.Level()
+}
+
+// SetLevel changes the level of the logger installed by Setup.
+func SetLevel(name string) error {
+	lvl, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(lvl)
+	return nil
+}
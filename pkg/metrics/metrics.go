@@ -0,0 +1,341 @@
+// Package metrics is a small Prometheus-compatible metrics registry. It
+// covers what fsak exports, counters, gauges and histograms with labels,
+// and serves them in the text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DurationBuckets are histogram buckets, in seconds, for dial and request
+// latencies.
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metrics in registration order and serves them over HTTP.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	_ = bw.Flush()
+}
+
+// Handler serves the registry on /metrics and answers 404 elsewhere.
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	return mux
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+}
+
+// vec keeps one child per distinct set of label values.
+type vec[T any] struct {
+	desc
+	mu       sync.Mutex
+	children map[string]*child[T]
+	newChild func() *T
+}
+
+type child[T any] struct {
+	values []string
+	v      *T
+}
+
+func newVec[T any](d desc, newChild func() *T) *vec[T] {
+	return &vec[T]{desc: d, children: make(map[string]*child[T]), newChild: newChild}
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.children[key]
+	if !ok {
+		c = &child[T]{values: append([]string(nil), values...), v: v.newChild()}
+		v.children[key] = c
+	}
+	return c.v
+}
+
+// sorted returns the children ordered by label values, so scrapes are
+// stable.
+func (v *vec[T]) sorted() []*child[T] {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*child[T], len(keys))
+	for i, k := range keys {
+		out[i] = v.children[k]
+	}
+	v.mu.Unlock()
+	return out
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) load() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value
+}
+
+func (c *Counter) Inc() { c.add(1) }
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) { c.add(delta) }
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(desc{name, help, "counter", labels}, func() *Counter { return new(Counter) })}
+	r.add(c)
+	return c
+}
+
+// With returns the counter for the label values, in label order.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	for _, ch := range c.sorted() {
+		writeSample(w, c.name, c.labels, ch.values, "", "", ch.v.load())
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Set(v float64)     { g.bits.Store(math.Float64bits(v)) }
+func (g *Gauge) Add(delta float64) { g.add(delta) }
+func (g *Gauge) Inc()              { g.add(1) }
+func (g *Gauge) Dec()              { g.add(-1) }
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+// Gauge registers a gauge with the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(desc{name, help, "gauge", labels}, func() *Gauge { return new(Gauge) })}
+	r.add(g)
+	return g
+}
+
+// With returns the gauge for the label values, in label order.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.with(values)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	for _, ch := range g.sorted() {
+		writeSample(w, g.name, g.labels, ch.values, "", "", ch.v.load())
+	}
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64 // per bucket, plus +Inf last
+	sum    value
+}
+
+// Observe records one observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.counts[i].Add(1)
+	h.sum.add(v)
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	*vec[Histogram]
+	buckets []float64
+}
+
+// Histogram registers a histogram with the given upper bucket bounds, which
+// must be sorted, and label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{buckets: buckets}
+	h.vec = newVec(desc{name, help, "histogram", labels}, func() *Histogram {
+		return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+	})
+	r.add(h)
+	return h
+}
+
+// With returns the histogram for the label values, in label order.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	for _, ch := range h.sorted() {
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += ch.v.counts[i].Load()
+			writeSample(w, h.name+"_bucket", h.labels, ch.values, "le", formatFloat(upper), float64(cumulative))
+		}
+		cumulative += ch.v.counts[len(h.buckets)].Load()
+		writeSample(w, h.name+"_bucket", h.labels, ch.values, "le", "+Inf", float64(cumulative))
+		writeSample(w, h.name+"_sum", h.labels, ch.values, "", "", ch.v.sum.load())
+		writeSample(w, h.name+"_count", h.labels, ch.values, "", "", float64(cumulative))
+	}
+}
+
+// collector reads its samples from a callback at scrape time, for values
+// that already live elsewhere.
+type collector struct {
+	desc
+	collect func(emit func(v float64, values ...string))
+}
+
+func (c *collector) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.collect(func(v float64, values ...string) {
+		writeSample(w, c.name, c.labels, values, "", "", v)
+	})
+}
+
+// CounterFunc registers a counter whose value is read from fn.
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.Collect(name, help, "counter", nil, func(emit func(float64, ...string)) {
+		emit(fn())
+	})
+}
+
+// GaugeFunc registers a gauge whose value is read from fn.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.Collect(name, help, "gauge", nil, func(emit func(float64, ...string)) {
+		emit(fn())
+	})
+}
+
+// Collect registers a metric of type typ ("counter" or "gauge") whose
+// samples collect emits at scrape time, one per set of label values.
+func (r *Registry) Collect(name, help, typ string, labels []string, collect func(emit func(v float64, values ...string))) {
+	r.add(&collector{desc{name, help, typ, labels}, collect})
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(values[i]))
+			w.WriteByte('"')
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel)
+			w.WriteString(`="`)
+			w.WriteString(extraValue)
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
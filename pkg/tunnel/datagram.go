@@ -0,0 +1,48 @@
+// Package tunnel holds the wire formats shared by the client and server
+// that live inside sealed tunnel frames.
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxDatagram is the largest UDP payload carried through the tunnel.
+const MaxDatagram = 65507
+
+var ErrDatagramShort = errors.New("datagram record too short")
+
+// DatagramLen is the encoded size of one datagram record.
+func DatagramLen(addr string, data []byte) int {
+	return 4 + len(addr) + len(data)
+}
+
+// AppendDatagram appends one record [addrLen(2)][addr][dataLen(2)][data]
+// to dst. addr is the remote "host:port".
+func AppendDatagram(dst []byte, addr string, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(addr)))
+	dst = append(dst, addr...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
+
+// NextDatagram decodes the first record in b and returns the rest. data
+// aliases b.
+func NextDatagram(b []byte) (addr string, data []byte, rest []byte, err error) {
+	if len(b) < 2 {
+		return "", nil, nil, ErrDatagramShort
+	}
+	addrLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < addrLen+2 {
+		return "", nil, nil, ErrDatagramShort
+	}
+	addr = string(b[:addrLen])
+	b = b[addrLen:]
+	dataLen := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < dataLen {
+		return "", nil, nil, ErrDatagramShort
+	}
+	return addr, b[:dataLen], b[dataLen:], nil
+}
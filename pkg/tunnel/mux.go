@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Mux frame types. A multiplexed session carries a sequence of mux frames
+// [type(1)][stream(4)][len(2)][data] in every upload and download payload.
+const (
+	// MuxOpen asks the server to dial the "host:port" in data.
+	MuxOpen byte = 1
+	// MuxReply reports the dial outcome: empty data on success, otherwise
+	// a dial failure code.
+	MuxReply byte = 2
+	// MuxData carries stream bytes.
+	MuxData byte = 3
+	// MuxClose ends the stream in both directions once the data already
+	// sent has been delivered.
+	MuxClose byte = 4
+	// MuxWindow grants the peer a 4-byte big-endian number of bytes more
+	// it may send on the stream.
+	MuxWindow byte = 5
+)
+
+const (
+	MuxHeaderLen = 7
+	// MuxMaxData is the largest data field of a single mux frame.
+	MuxMaxData = 32 * 1024
+	// MuxInitialWindow is how many bytes each side may send on a new
+	// stream before the first window update.
+	MuxInitialWindow = 256 * 1024
+)
+
+var ErrMuxShort = errors.New("mux frame too short")
+
+// AppendMuxFrame appends one mux frame to dst. data must not exceed
+// MuxMaxData.
+func AppendMuxFrame(dst []byte, typ byte, stream uint32, data []byte) []byte {
+	dst = append(dst, typ)
+	dst = binary.BigEndian.AppendUint32(dst, stream)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
+
+// AppendMuxWindow appends a window update granting n more bytes.
+func AppendMuxWindow(dst []byte, stream uint32, n int) []byte {
+	var inc [4]byte
+	binary.BigEndian.PutUint32(inc[:], uint32(n))
+	return AppendMuxFrame(dst, MuxWindow, stream, inc[:])
+}
+
+// NextMuxFrame decodes the first frame in b and returns the rest. data
+// aliases b.
+func NextMuxFrame(b []byte) (typ byte, stream uint32, data []byte, rest []byte, err error) {
+	if len(b) < MuxHeaderLen {
+		return 0, 0, nil, nil, ErrMuxShort
+	}
+	typ = b[0]
+	stream = binary.BigEndian.Uint32(b[1:5])
+	n := int(binary.BigEndian.Uint16(b[5:7]))
+	if len(b) < MuxHeaderLen+n {
+		return 0, 0, nil, nil, ErrMuxShort
+	}
+	return typ, stream, b[MuxHeaderLen : MuxHeaderLen+n], b[MuxHeaderLen+n:], nil
+}
+
+// MuxWindowIncrement decodes the data of a MuxWindow frame.
+func MuxWindowIncrement(data []byte) (int, error) {
+	if len(data) != 4 {
+		return 0, ErrMuxShort
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+// MuxPrefix returns the length of the longest prefix of b made of whole
+// frames that fits in max bytes. At least one frame is always included so
+// a caller can make progress.
+func MuxPrefix(b []byte, max int) int {
+	n := 0
+	for n < len(b) {
+		if len(b)-n < MuxHeaderLen {
+			return len(b)
+		}
+		size := MuxHeaderLen + int(binary.BigEndian.Uint16(b[n+5:n+7]))
+		if n > 0 && n+size > max {
+			break
+		}
+		n += size
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	return n
+}
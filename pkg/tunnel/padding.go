@@ -0,0 +1,36 @@
+package tunnel
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Padded frames carry a [padLen(2)] field after their header and that many
+// filler bytes after the payload, all inside the encryption. Upload frames
+// set a flag for it; download frames are padded for sessions whose uploads
+// are.
+const (
+	PadHeader = 2
+	// MaxPadding bounds the padding of one frame.
+	MaxPadding = 16 * 1024
+)
+
+// PadLen picks a uniformly random padding length in [0, max], with max
+// clamped to MaxPadding.
+func PadLen(max int) int {
+	if max <= 0 {
+		return 0
+	}
+	if max > MaxPadding {
+		max = MaxPadding
+	}
+	return rand.IntN(max + 1)
+}
+
+// Jitter sleeps for a random duration in [0, max).
+func Jitter(max time.Duration) {
+	if max <= 0 {
+		return
+	}
+	time.Sleep(rand.N(max))
+}
@@ -0,0 +1,275 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/paulGUZU/fsak/pkg/config"
+)
+
+// RequestKind is the role of a tunnel request.
+type RequestKind int
+
+const (
+	RequestUpload RequestKind = iota + 1
+	RequestDownload
+	RequestWebSocket
+)
+
+func (k RequestKind) String() string {
+	switch k {
+	case RequestUpload:
+		return "upload"
+	case RequestDownload:
+		return "download"
+	case RequestWebSocket:
+		return "websocket"
+	default:
+		return "unknown"
+	}
+}
+
+// Where the session ID and auth token travel in a request.
+const (
+	SessionInQuery  = "query"
+	SessionInCookie = "cookie"
+	SessionInHeader = "header"
+	SessionInPath   = "path"
+)
+
+// Path template placeholders, each standing for a whole path segment.
+const (
+	placeholderSession = "{session}"
+	placeholderAuth    = "{auth}"
+)
+
+const defaultWSPath = "/ws"
+
+// Shape describes how tunnel requests look on the wire. The client builds
+// requests from it and the server routes them with it, so both ends must
+// be configured with the same profile.
+type Shape struct {
+	routes       [RequestWebSocket + 1]route
+	sessionIn    string
+	sessionName  string
+	authName     string
+	headers      http.Header
+	uploadType   string
+	downloadType string
+}
+
+type route struct {
+	method   string
+	segments []string
+}
+
+// NewShape validates the profile section of cfg and fills in the defaults,
+// which reproduce the original request layout.
+func NewShape(cfg *config.Config) (*Shape, error) {
+	p := cfg.Profile
+	s := &Shape{
+		sessionIn:    strings.ToLower(strings.TrimSpace(p.SessionIn)),
+		sessionName:  orDefault(p.SessionName, "session_id"),
+		authName:     orDefault(p.AuthName, "auth"),
+		headers:      make(http.Header, len(p.Headers)),
+		uploadType:   orDefault(p.UploadContentType, "application/octet-stream"),
+		downloadType: orDefault(p.DownloadContentType, "application/octet-stream"),
+	}
+	switch s.sessionIn {
+	case "":
+		s.sessionIn = SessionInQuery
+	case SessionInQuery, SessionInCookie, SessionInHeader, SessionInPath:
+	default:
+		return nil, fmt.Errorf("unknown profile session_in %q", p.SessionIn)
+	}
+	for name, value := range p.Headers {
+		s.headers.Set(name, value)
+	}
+
+	templates := []struct {
+		kind          RequestKind
+		method, path  string
+		defaultMethod string
+		defaultPath   string
+	}{
+		{RequestUpload, p.UploadMethod, p.UploadPath, http.MethodPost, "/upload"},
+		{RequestDownload, p.DownloadMethod, p.DownloadPath, http.MethodGet, "/download"},
+		{RequestWebSocket, http.MethodGet, cfg.WSPath, http.MethodGet, defaultWSPath},
+	}
+	for _, tpl := range templates {
+		r, err := s.parseRoute(orDefault(tpl.method, tpl.defaultMethod), orDefault(tpl.path, tpl.defaultPath))
+		if err != nil {
+			return nil, err
+		}
+		s.routes[tpl.kind] = r
+	}
+	if s.routes[RequestUpload].equal(s.routes[RequestDownload]) {
+		return nil, fmt.Errorf("profile upload and download requests must differ in method or path")
+	}
+	return s, nil
+}
+
+func (s *Shape) parseRoute(method, path string) (route, error) {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if method == http.MethodHead {
+		return route{}, fmt.Errorf("profile method %s cannot carry tunnel data", method)
+	}
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "/") {
+		return route{}, fmt.Errorf("profile path %q must start with /", path)
+	}
+	if s.sessionIn == SessionInPath && !strings.Contains(path, placeholderSession) {
+		path = strings.TrimSuffix(path, "/") + "/" + placeholderSession + "/" + placeholderAuth
+	}
+
+	segments := strings.Split(path, "/")
+	var haveSession, haveAuth bool
+	for _, seg := range segments {
+		switch {
+		case seg == placeholderSession:
+			haveSession = true
+		case seg == placeholderAuth:
+			haveAuth = true
+		case strings.ContainsAny(seg, "{}"):
+			return route{}, fmt.Errorf("profile path %q: placeholders must be whole segments", path)
+		}
+	}
+	if s.sessionIn == SessionInPath {
+		if !haveSession || !haveAuth {
+			return route{}, fmt.Errorf("profile path %q needs both %s and %s", path, placeholderSession, placeholderAuth)
+		}
+	} else if haveSession || haveAuth {
+		return route{}, fmt.Errorf("profile path %q has placeholders but session_in is %s", path, s.sessionIn)
+	}
+	return route{method: method, segments: segments}, nil
+}
+
+func (r route) equal(o route) bool {
+	return r.method == o.method && strings.Join(r.segments, "/") == strings.Join(o.segments, "/")
+}
+
+func (r route) expand(sessionID, auth string) string {
+	out := make([]string, len(r.segments))
+	for i, seg := range r.segments {
+		switch seg {
+		case placeholderSession:
+			out[i] = url.PathEscape(sessionID)
+		case placeholderAuth:
+			out[i] = url.PathEscape(auth)
+		default:
+			out[i] = seg
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// match reports whether path fits the template and returns the values of
+// its placeholders.
+func (r route) match(path string) (sessionID, auth string, ok bool) {
+	segments := strings.Split(path, "/")
+	if len(segments) != len(r.segments) {
+		return "", "", false
+	}
+	for i, seg := range r.segments {
+		switch seg {
+		case placeholderSession:
+			sessionID = segments[i]
+		case placeholderAuth:
+			auth = segments[i]
+		default:
+			if segments[i] != seg {
+				return "", "", false
+			}
+		}
+	}
+	return sessionID, auth, true
+}
+
+// NewRequest builds a kind request for the session against baseURL
+// ("scheme://host:port"). The caller sets Host.
+func (s *Shape) NewRequest(ctx context.Context, kind RequestKind, baseURL, sessionID, auth string, body io.Reader) (*http.Request, error) {
+	r := s.routes[kind]
+	target := baseURL + r.expand(sessionID, auth)
+	if s.sessionIn == SessionInQuery {
+		target += "?" + url.Values{s.sessionName: {sessionID}, s.authName: {auth}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range s.headers {
+		req.Header[name] = values
+	}
+	switch s.sessionIn {
+	case SessionInCookie:
+		req.AddCookie(&http.Cookie{Name: s.sessionName, Value: sessionID})
+		req.AddCookie(&http.Cookie{Name: s.authName, Value: auth})
+	case SessionInHeader:
+		req.Header.Set(s.sessionName, sessionID)
+		req.Header.Set(s.authName, auth)
+	}
+	if kind == RequestUpload {
+		req.Header.Set("Content-Type", s.uploadType)
+	}
+	return req, nil
+}
+
+// Match classifies r. It returns 0 when r is not a tunnel request, in which
+// case it should be answered like any other web request.
+func (s *Shape) Match(r *http.Request) (kind RequestKind, sessionID, auth string) {
+	kinds := []RequestKind{RequestUpload, RequestDownload}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		kinds = []RequestKind{RequestWebSocket}
+	}
+	for _, k := range kinds {
+		route := s.routes[k]
+		if r.Method != route.method {
+			continue
+		}
+		pathSession, pathAuth, ok := route.match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		switch s.sessionIn {
+		case SessionInQuery:
+			query := r.URL.Query()
+			sessionID, auth = query.Get(s.sessionName), query.Get(s.authName)
+		case SessionInCookie:
+			sessionID, auth = cookieValue(r, s.sessionName), cookieValue(r, s.authName)
+		case SessionInHeader:
+			sessionID, auth = r.Header.Get(s.sessionName), r.Header.Get(s.authName)
+		case SessionInPath:
+			sessionID, _ = url.PathUnescape(pathSession)
+			auth, _ = url.PathUnescape(pathAuth)
+		}
+		if sessionID == "" {
+			return 0, "", ""
+		}
+		return k, sessionID, auth
+	}
+	return 0, "", ""
+}
+
+// DownloadContentType is the Content-Type of download responses.
+func (s *Shape) DownloadContentType() string {
+	return s.downloadType
+}
+
+func cookieValue(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func orDefault(v, def string) string {
+	if v = strings.TrimSpace(v); v != "" {
+		return v
+	}
+	return def
+}